@@ -95,3 +95,10 @@ Create the full image name for the CSI node driver registrar
 {{- define "btrfs-csi.nodeDriverRegistrarImage" -}}
 {{- printf "%s:%s" .Values.csiNodeDriverRegistrar.image.repository .Values.csiNodeDriverRegistrar.image.tag }}
 {{- end }}
+
+{{/*
+Create the full image name for the CSI snapshotter
+*/}}
+{{- define "btrfs-csi.snapshotterImage" -}}
+{{- printf "%s:%s" .Values.csiSnapshotter.image.repository .Values.csiSnapshotter.image.tag }}
+{{- end }}
@@ -0,0 +1,36 @@
+package btrfs
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Inode flags of FS_IOC_GETFLAGS and FS_IOC_SETFLAGS, see linux/fs.h
+const (
+	fsNoCOWFlag = 0x00800000 // FS_NOCOW_FL, the "C" attribute of chattr
+)
+
+// SetNoCOW disables copy-on-write for the data of the given file or directory, like "chattr +C".
+// Btrfs only applies it to empty files; files created in a directory inherit it from the directory.
+// Data without copy-on-write is also not checksummed and not compressed.
+func SetNoCOW(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return fmt.Errorf("failed to get attributes of %s: %w", path, err)
+	}
+	if flags&fsNoCOWFlag != 0 {
+		return nil
+	}
+	if err := unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(flags|fsNoCOWFlag)); err != nil {
+		return fmt.Errorf("failed to disable copy-on-write for %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// compressionXattr is the extended attribute behind the "compression" property of btrfs-progs
+	compressionXattr = "btrfs.compression"
+
+	// item key of struct btrfs_file_extent_item
+	extentDataKey = 108
+
+	// file extent types
+	fileExtentInline  = 0
+	fileExtentRegular = 1
+
+	// size of struct btrfs_file_extent_item up to the inline data
+	fileExtentInlineDataStart = 21
+	fileExtentItemSize        = 53
+)
+
+// CompressionStats contains the amount of file data of a subvolume before and after compression
+type CompressionStats struct {
+	UncompressedBytes int64 // bytes of file data referenced by the subvolume
+	DiskBytes         int64 // bytes this data takes up on disk
+}
+
+// Ratio returns the compression ratio, i.e. the disk bytes per uncompressed byte (1 if there is no data)
+func (s CompressionStats) Ratio() float64 {
+	if s.UncompressedBytes == 0 {
+		return 1
+	}
+	return float64(s.DiskBytes) / float64(s.UncompressedBytes)
+}
+
+// SetCompression sets the compression of the given file or directory, like "btrfs property set <path> compression <value>".
+// The value is an algorithm (zlib, lzo or zstd) or "none" to disable compression; the kernel ignores levels
+// (e.g. "zstd:3") and uses the default level of the algorithm. Files created in a directory inherit its compression.
+func SetCompression(path, value string) error {
+	if err := unix.Setxattr(path, compressionXattr, []byte(value), 0); err != nil {
+		return fmt.Errorf("failed to set compression of %s to %s: %w", path, value, err)
+	}
+	return nil
+}
+
+// GetCompressionStats returns the compression statistics of the subvolume containing the given path,
+// computed from the file extents of the subvolume. Data shared with other subvolumes is included.
+func GetCompressionStats(path string) (CompressionStats, error) {
+	stats := CompressionStats{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return stats, err
+	}
+	defer f.Close()
+
+	// Tree ID 0 searches the tree of the subvolume containing the file
+	err = searchTree(f, 0, extentDataKey, func(item searchItem) {
+		addFileExtent(&stats, item.data)
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to search file extents of %s: %w", path, err)
+	}
+	return stats, nil
+}
+
+// addFileExtent adds the data referenced by a file extent item to the statistics
+func addFileExtent(stats *CompressionStats, data []byte) {
+	if len(data) < fileExtentInlineDataStart {
+		return
+	}
+	// struct btrfs_file_extent_item: generation, ram_bytes, compression, encryption, other_encoding, type,
+	// followed by the inline data or disk_bytenr, disk_num_bytes, offset, num_bytes
+	ramBytes := int64(binary.LittleEndian.Uint64(data[8:16]))
+	compression := data[16]
+
+	switch data[20] {
+	case fileExtentInline:
+		stats.UncompressedBytes += ramBytes
+		stats.DiskBytes += int64(len(data) - fileExtentInlineDataStart)
+	case fileExtentRegular:
+		if len(data) < fileExtentItemSize {
+			return
+		}
+		diskBytenr := binary.LittleEndian.Uint64(data[21:29])
+		diskNumBytes := int64(binary.LittleEndian.Uint64(data[29:37]))
+		numBytes := int64(binary.LittleEndian.Uint64(data[45:53]))
+		if diskBytenr == 0 {
+			// holes of sparse files
+			return
+		}
+		stats.UncompressedBytes += numBytes
+		if compression != 0 && ramBytes > 0 {
+			// A file may only reference part of a compressed extent
+			stats.DiskBytes += int64(float64(numBytes) * float64(diskNumBytes) / float64(ramBytes))
+		} else {
+			stats.DiskBytes += numBytes
+		}
+	}
+	// Preallocated extents do not contain any data yet
+}
+
+// searchTree calls fn for all items of the given type in a tree
+func searchTree(f *os.File, treeID uint64, typ uint32, fn func(searchItem)) error {
+	key := searchKey{
+		treeID:      treeID,
+		maxObjectID: math.MaxUint64,
+		minType:     typ,
+		maxType:     typ,
+		maxOffset:   math.MaxUint64,
+		maxTransID:  math.MaxUint64,
+	}
+	for {
+		args := searchArgs{key: key}
+		args.key.nrItems = math.MaxUint32
+		if err := ioctl(f.Fd(), iocTreeSearch, unsafe.Pointer(&args)); err != nil {
+			return err
+		}
+		items := parseSearchItems(&args)
+		if len(items) == 0 {
+			return nil
+		}
+
+		// The search covers a range of keys, so items of other types are returned as well
+		for _, item := range items {
+			if item.typ == typ {
+				fn(item)
+			}
+		}
+
+		// Continue with the key following the last item
+		last := items[len(items)-1]
+		key.minObjectID, key.minType, key.minOffset = last.objectID, last.typ, last.offset
+		switch {
+		case key.minOffset < math.MaxUint64:
+			key.minOffset++
+		case key.minType < math.MaxUint8:
+			key.minType++
+			key.minOffset = 0
+		case key.minObjectID < math.MaxUint64:
+			key.minObjectID++
+			key.minType = 0
+			key.minOffset = 0
+		default:
+			return nil
+		}
+	}
+}
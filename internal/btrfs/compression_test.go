@@ -0,0 +1,55 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// fileExtentItem encodes a struct btrfs_file_extent_item of a regular extent
+func fileExtentItem(ramBytes uint64, compression uint8, diskBytenr, diskNumBytes, numBytes uint64) []byte {
+	data := make([]byte, fileExtentItemSize)
+	binary.LittleEndian.PutUint64(data[8:16], ramBytes)
+	data[16] = compression
+	data[20] = fileExtentRegular
+	binary.LittleEndian.PutUint64(data[21:29], diskBytenr)
+	binary.LittleEndian.PutUint64(data[29:37], diskNumBytes)
+	binary.LittleEndian.PutUint64(data[45:53], numBytes)
+	return data
+}
+
+// TestAddFileExtent verifies the accounting of file extent items
+func TestAddFileExtent(t *testing.T) {
+	stats := CompressionStats{}
+
+	// An uncompressed extent of 1 MiB
+	addFileExtent(&stats, fileExtentItem(1<<20, 0, 4096, 1<<20, 1<<20))
+	// A zstd compressed extent of 128 KiB stored in 32 KiB, of which the file references half
+	addFileExtent(&stats, fileExtentItem(128<<10, 3, 8192, 32<<10, 64<<10))
+	// A hole does not take up any space
+	addFileExtent(&stats, fileExtentItem(1<<20, 0, 0, 0, 1<<20))
+	// An inline extent of 100 bytes stored in 40 bytes
+	inline := make([]byte, fileExtentInlineDataStart+40)
+	binary.LittleEndian.PutUint64(inline[8:16], 100)
+	inline[16] = 1
+	inline[20] = fileExtentInline
+	addFileExtent(&stats, inline)
+	// A truncated item is ignored
+	addFileExtent(&stats, make([]byte, 8))
+
+	if expected := int64(1<<20 + 64<<10 + 100); stats.UncompressedBytes != expected {
+		t.Errorf("Expected %d uncompressed bytes, got %d", expected, stats.UncompressedBytes)
+	}
+	if expected := int64(1<<20 + 16<<10 + 40); stats.DiskBytes != expected {
+		t.Errorf("Expected %d disk bytes, got %d", expected, stats.DiskBytes)
+	}
+}
+
+// TestCompressionRatio verifies the compression ratio of empty and compressed data
+func TestCompressionRatio(t *testing.T) {
+	if ratio := (CompressionStats{}).Ratio(); ratio != 1 {
+		t.Errorf("Expected ratio 1 without data, got %f", ratio)
+	}
+	if ratio := (CompressionStats{UncompressedBytes: 400, DiskBytes: 100}).Ratio(); ratio != 0.25 {
+		t.Errorf("Expected ratio 0.25, got %f", ratio)
+	}
+}
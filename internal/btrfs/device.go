@@ -0,0 +1,73 @@
+package btrfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// DeviceStats contains the error counters of a device of a Btrfs filesystem
+type DeviceStats struct {
+	DevID            uint64
+	Path             string
+	Missing          bool // the device is missing from the (degraded) filesystem
+	WriteErrors      uint64
+	ReadErrors       uint64
+	FlushErrors      uint64
+	CorruptionErrors uint64
+	GenerationErrors uint64
+}
+
+// Errors returns the total number of errors of the device
+func (s DeviceStats) Errors() uint64 {
+	return s.WriteErrors + s.ReadErrors + s.FlushErrors + s.CorruptionErrors + s.GenerationErrors
+}
+
+// GetDeviceStats returns the error counters of all devices of the Btrfs filesystem
+// the given path is located on
+func GetDeviceStats(path string) ([]DeviceStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fsInfo := fsInfoArgs{}
+	if err := ioctl(f.Fd(), iocFsInfo, unsafe.Pointer(&fsInfo)); err != nil {
+		return nil, fmt.Errorf("failed to get filesystem info of %s: %w", path, err)
+	}
+
+	stats := []DeviceStats{}
+	for devid := uint64(1); devid <= fsInfo.maxID; devid++ {
+		devInfo := devInfoArgs{devid: devid}
+		if err := ioctl(f.Fd(), iocDevInfo, unsafe.Pointer(&devInfo)); err != nil {
+			// Device IDs of removed devices are not reused
+			if errors.Is(err, unix.ENODEV) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to get info of device %d of %s: %w", devid, path, err)
+		}
+
+		devStats := getDevStatsArgs{devid: devid, nrItems: devStatValues}
+		if err := ioctl(f.Fd(), iocGetDevStats, unsafe.Pointer(&devStats)); err != nil {
+			return nil, fmt.Errorf("failed to get stats of device %d of %s: %w", devid, path, err)
+		}
+
+		devicePath := string(bytes.TrimRight(devInfo.path[:], "\x00"))
+		stats = append(stats, DeviceStats{
+			DevID:            devid,
+			Path:             devicePath,
+			Missing:          devicePath == "",
+			WriteErrors:      devStats.values[0],
+			ReadErrors:       devStats.values[1],
+			FlushErrors:      devStats.values[2],
+			CorruptionErrors: devStats.values[3],
+			GenerationErrors: devStats.values[4],
+		})
+	}
+	return stats, nil
+}
@@ -0,0 +1,223 @@
+package btrfs
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants from the kernel headers (include/uapi/linux/btrfs.h and btrfs_tree.h)
+const (
+	ioctlMagic = 0x94
+
+	volNameMax      = 255
+	pathNameMax     = 4087
+	subvolNameMax   = 4039
+	inoLookupPath   = 4080
+	searchBufSize   = 4096 - int(unsafe.Sizeof(searchKey{}))
+	fsInfoReserved  = 944
+	devicePathMax   = 1024
+	devStatValues   = 5
+	uuidSize        = 16
+	firstFreeObject = 256
+
+	// subvolume flags
+	subvolReadOnly = 1 << 1
+
+	// qgroup limit flags
+	qgroupLimitMaxReferenced = 1 << 0
+	qgroupLimitMaxExclusive  = 1 << 1
+
+	// quota control commands
+	quotaCtlEnable            = 1
+	quotaCtlEnableSimpleQuota = 4
+
+	// qgroup status flags
+	qgroupStatusFlagOn           = 1 << 0
+	qgroupStatusFlagRescan       = 1 << 1
+	qgroupStatusFlagInconsistent = 1 << 2
+	qgroupStatusFlagSimpleMode   = 1 << 3
+
+	// tree IDs and item keys
+	rootTreeObjectID  = 1
+	quotaTreeObjectID = 8
+	rootBackrefKey    = 144
+	qgroupStatusKey   = 240
+	qgroupInfoKey     = 242
+	qgroupLimitKey    = 244
+)
+
+const (
+	iocWrite = 1
+	iocRead  = 2
+)
+
+func ioc(dir, nr, size uintptr) uintptr {
+	return dir<<30 | size<<16 | ioctlMagic<<8 | nr
+}
+
+func ior(nr, size uintptr) uintptr  { return ioc(iocRead, nr, size) }
+func iow(nr, size uintptr) uintptr  { return ioc(iocWrite, nr, size) }
+func iowr(nr, size uintptr) uintptr { return ioc(iocRead|iocWrite, nr, size) }
+
+// struct btrfs_ioctl_vol_args
+type volArgs struct {
+	fd   int64
+	name [pathNameMax + 1]byte
+}
+
+// struct btrfs_ioctl_vol_args_v2
+type volArgsV2 struct {
+	fd      int64
+	transid uint64
+	flags   uint64
+	unused  [4]uint64
+	name    [subvolNameMax + 1]byte
+}
+
+// struct btrfs_ioctl_ino_lookup_args
+type inoLookupArgs struct {
+	treeid   uint64
+	objectid uint64
+	name     [inoLookupPath]byte
+}
+
+// struct btrfs_ioctl_search_key
+type searchKey struct {
+	treeID      uint64
+	minObjectID uint64
+	maxObjectID uint64
+	minOffset   uint64
+	maxOffset   uint64
+	minTransID  uint64
+	maxTransID  uint64
+	minType     uint32
+	maxType     uint32
+	nrItems     uint32
+	_           uint32
+	_           [4]uint64
+}
+
+// struct btrfs_ioctl_search_header
+type searchHeader struct {
+	transID  uint64
+	objectID uint64
+	offset   uint64
+	typ      uint32
+	len      uint32
+}
+
+// struct btrfs_ioctl_search_args
+type searchArgs struct {
+	key searchKey
+	buf [searchBufSize]byte
+}
+
+// struct btrfs_ioctl_fs_info_args
+type fsInfoArgs struct {
+	maxID          uint64
+	numDevices     uint64
+	fsid           [uuidSize]byte
+	nodesize       uint32
+	sectorsize     uint32
+	cloneAlignment uint32
+	csumType       uint16
+	csumSize       uint16
+	flags          uint64
+	generation     uint64
+	metadataUUID   [uuidSize]byte
+	_              [fsInfoReserved]byte
+}
+
+// struct btrfs_ioctl_dev_info_args
+type devInfoArgs struct {
+	devid      uint64
+	uuid       [uuidSize]byte
+	bytesUsed  uint64
+	totalBytes uint64
+	fsid       [uuidSize]byte
+	_          [377]uint64
+	path       [devicePathMax]byte
+}
+
+// struct btrfs_ioctl_get_dev_stats
+type getDevStatsArgs struct {
+	devid   uint64
+	nrItems uint64
+	flags   uint64
+	values  [devStatValues]uint64
+	_       [128 - 2 - devStatValues]uint64
+}
+
+// struct btrfs_ioctl_quota_ctl_args
+type quotaCtlArgs struct {
+	cmd    uint64
+	status uint64
+}
+
+// struct btrfs_qgroup_limit
+type qgroupLimit struct {
+	flags         uint64
+	maxReferenced uint64
+	maxExclusive  uint64
+	rsvReferenced uint64
+	rsvExclusive  uint64
+}
+
+// struct btrfs_ioctl_qgroup_limit_args
+type qgroupLimitArgs struct {
+	qgroupID uint64
+	limit    qgroupLimit
+}
+
+// struct btrfs_ioctl_timespec
+type ioctlTimespec struct {
+	sec  uint64
+	nsec uint32
+}
+
+// struct btrfs_ioctl_get_subvol_info_args
+type getSubvolInfoArgs struct {
+	treeID       uint64
+	name         [volNameMax + 1]byte
+	parentID     uint64
+	dirID        uint64
+	generation   uint64
+	flags        uint64
+	uuid         [uuidSize]byte
+	parentUUID   [uuidSize]byte
+	receivedUUID [uuidSize]byte
+	ctransid     uint64
+	otransid     uint64
+	stransid     uint64
+	rtransid     uint64
+	ctime        ioctlTimespec
+	otime        ioctlTimespec
+	stime        ioctlTimespec
+	rtime        ioctlTimespec
+	_            [8]uint64
+}
+
+var (
+	iocSnapCreateV2  = iow(23, unsafe.Sizeof(volArgsV2{}))
+	iocSubvolCreate  = iow(14, unsafe.Sizeof(volArgs{}))
+	iocSnapDestroy   = iow(15, unsafe.Sizeof(volArgs{}))
+	iocTreeSearch    = iowr(17, unsafe.Sizeof(searchArgs{}))
+	iocInoLookup     = iowr(18, unsafe.Sizeof(inoLookupArgs{}))
+	iocSpaceInfo     = iowr(20, unsafe.Sizeof([2]uint64{}))
+	iocSubvolGetFlag = ior(25, unsafe.Sizeof(uint64(0)))
+	iocDevInfo       = iowr(30, unsafe.Sizeof(devInfoArgs{}))
+	iocFsInfo        = ior(31, unsafe.Sizeof(fsInfoArgs{}))
+	iocGetDevStats   = iowr(52, unsafe.Sizeof(getDevStatsArgs{}))
+	iocQuotaCtl      = iowr(40, unsafe.Sizeof(quotaCtlArgs{}))
+	iocQgroupLimit   = ior(43, unsafe.Sizeof(qgroupLimitArgs{}))
+	iocGetSubvolInfo = ior(60, unsafe.Sizeof(getSubvolInfoArgs{}))
+)
+
+// ioctl performs the given ioctl request on the file descriptor
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
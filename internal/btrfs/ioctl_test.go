@@ -0,0 +1,93 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+)
+
+// TestIoctlArgSizes verifies that the ioctl argument structs match the kernel's layout
+func TestIoctlArgSizes(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     uintptr
+		expected uintptr
+	}{
+		{"btrfs_ioctl_vol_args", unsafe.Sizeof(volArgs{}), 4096},
+		{"btrfs_ioctl_vol_args_v2", unsafe.Sizeof(volArgsV2{}), 4096},
+		{"btrfs_ioctl_ino_lookup_args", unsafe.Sizeof(inoLookupArgs{}), 4096},
+		{"btrfs_ioctl_search_key", unsafe.Sizeof(searchKey{}), 104},
+		{"btrfs_ioctl_search_header", unsafe.Sizeof(searchHeader{}), 32},
+		{"btrfs_ioctl_search_args", unsafe.Sizeof(searchArgs{}), 4096},
+		{"btrfs_ioctl_fs_info_args", unsafe.Sizeof(fsInfoArgs{}), 1024},
+		{"btrfs_ioctl_dev_info_args", unsafe.Sizeof(devInfoArgs{}), 4096},
+		{"btrfs_ioctl_get_dev_stats", unsafe.Sizeof(getDevStatsArgs{}), 1032},
+		{"btrfs_ioctl_quota_ctl_args", unsafe.Sizeof(quotaCtlArgs{}), 16},
+		{"btrfs_ioctl_qgroup_limit_args", unsafe.Sizeof(qgroupLimitArgs{}), 48},
+		{"btrfs_ioctl_get_subvol_info_args", unsafe.Sizeof(getSubvolInfoArgs{}), 504},
+	}
+
+	for _, tt := range tests {
+		if tt.size != tt.expected {
+			t.Errorf("Expected size of %s to be %d, got %d", tt.name, tt.expected, tt.size)
+		}
+	}
+}
+
+// TestIoctlNumbers verifies the ioctl request numbers against the values from the kernel headers
+func TestIoctlNumbers(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      uintptr
+		expected uintptr
+	}{
+		{"BTRFS_IOC_SUBVOL_CREATE", iocSubvolCreate, 0x5000940e},
+		{"BTRFS_IOC_SNAP_DESTROY", iocSnapDestroy, 0x5000940f},
+		{"BTRFS_IOC_SNAP_CREATE_V2", iocSnapCreateV2, 0x50009417},
+		{"BTRFS_IOC_TREE_SEARCH", iocTreeSearch, 0xd0009411},
+		{"BTRFS_IOC_INO_LOOKUP", iocInoLookup, 0xd0009412},
+		{"BTRFS_IOC_SPACE_INFO", iocSpaceInfo, 0xc0109414},
+		{"BTRFS_IOC_SUBVOL_GETFLAGS", iocSubvolGetFlag, 0x80089419},
+		{"BTRFS_IOC_DEV_INFO", iocDevInfo, 0xd000941e},
+		{"BTRFS_IOC_FS_INFO", iocFsInfo, 0x8400941f},
+		{"BTRFS_IOC_GET_DEV_STATS", iocGetDevStats, 0xc4089434},
+		{"BTRFS_IOC_QUOTA_CTL", iocQuotaCtl, 0xc0109428},
+		{"BTRFS_IOC_QGROUP_LIMIT", iocQgroupLimit, 0x8030942b},
+		{"BTRFS_IOC_GET_SUBVOL_INFO", iocGetSubvolInfo, 0x81f8943c},
+	}
+
+	for _, tt := range tests {
+		if tt.req != tt.expected {
+			t.Errorf("Expected %s to be %#x, got %#x", tt.name, tt.expected, tt.req)
+		}
+	}
+}
+
+func TestFormatUUID(t *testing.T) {
+	uuid := [uuidSize]byte{0x3b, 0x5e, 0x4a, 0x8c, 0x0d, 0x5f, 0x4c, 0x1e, 0x9a, 0x51, 0x2b, 0x7f, 0x0f, 0x6c, 0x2d, 0x11}
+	if got := formatUUID(uuid); got != "3b5e4a8c-0d5f-4c1e-9a51-2b7f0f6c2d11" {
+		t.Errorf("Unexpected UUID %s", got)
+	}
+	if got := formatUUID([uuidSize]byte{}); got != "" {
+		t.Errorf("Expected empty UUID, got %s", got)
+	}
+}
+
+func TestParseRootRef(t *testing.T) {
+	data := make([]byte, 18, 18+5)
+	binary.LittleEndian.PutUint64(data[0:8], 256)
+	binary.LittleEndian.PutUint16(data[16:18], 5)
+	data = append(data, "pvc-1"...)
+
+	name, err := parseRootRef(data)
+	if err != nil || name != "pvc-1" {
+		t.Errorf("Expected name pvc-1, got %q (error: %v)", name, err)
+	}
+
+	if _, err := parseRootRef(data[:20]); err == nil {
+		t.Error("Expected an error for a truncated name")
+	}
+	if _, err := parseRootRef(data[:10]); err == nil {
+		t.Error("Expected an error for a truncated root ref")
+	}
+}
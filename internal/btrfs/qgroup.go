@@ -0,0 +1,255 @@
+package btrfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrQuotaDisabled is returned by qgroup operations on filesystems without quotas enabled
+var ErrQuotaDisabled = errors.New("quotas are not enabled")
+
+// QuotaStatus contains the state of quota accounting of a Btrfs filesystem
+type QuotaStatus struct {
+	Enabled      bool
+	Inconsistent bool // accounting is inconsistent and needs a rescan
+	Rescanning   bool // a rescan is in progress
+	Simple       bool // simple quotas (squota) are used instead of full qgroup accounting
+	// EnableGeneration is the transaction in which simple quotas were enabled.
+	// Simple quotas do not account for extents written before.
+	EnableGeneration uint64
+}
+
+// simpleQuotaFeature is the sysfs file that exists if the kernel supports simple quotas
+const simpleQuotaFeature = "/sys/fs/btrfs/features/simple_quota"
+
+// SupportsSimpleQuota checks whether the running kernel supports simple quotas (Linux 6.7+)
+func SupportsSimpleQuota() bool {
+	_, err := os.Stat(simpleQuotaFeature)
+	return err == nil
+}
+
+// QgroupInfo contains the accounting information of a Btrfs subvolume's level 0 qgroup
+type QgroupInfo struct {
+	ID            uint64
+	Referenced    int64 // Referenced bytes
+	Exclusive     int64 // Exclusive bytes
+	MaxReferenced int64 // Referenced bytes limit (0 if unlimited)
+	MaxExclusive  int64 // Exclusive bytes limit (0 if unlimited)
+}
+
+// searchItem is a single item returned from a tree search
+type searchItem struct {
+	objectID uint64
+	offset   uint64
+	typ      uint32
+	data     []byte
+}
+
+// GetQuotaStatus returns the quota status of the Btrfs filesystem the given path is located on
+func GetQuotaStatus(path string) (QuotaStatus, error) {
+	status := QuotaStatus{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return status, err
+	}
+	defer f.Close()
+
+	items, err := treeSearch(f, quotaTreeObjectID, 0, qgroupStatusKey, 0)
+	if errors.Is(err, unix.ENOENT) {
+		// The quota tree does not exist if quotas were never enabled
+		return status, nil
+	}
+	if err != nil {
+		return status, fmt.Errorf("failed to get quota status of %s: %w", path, err)
+	}
+	if len(items) == 0 {
+		return status, nil
+	}
+
+	// struct btrfs_qgroup_status_item: version, generation, flags, rescan, enable_gen
+	data := items[0].data
+	if len(data) < 24 {
+		return status, fmt.Errorf("invalid qgroup status item of size %d", len(data))
+	}
+	flags := binary.LittleEndian.Uint64(data[16:24])
+	status.Enabled = flags&qgroupStatusFlagOn != 0
+	status.Rescanning = flags&qgroupStatusFlagRescan != 0
+	status.Inconsistent = flags&qgroupStatusFlagInconsistent != 0
+	status.Simple = flags&qgroupStatusFlagSimpleMode != 0
+	if status.Simple && len(data) >= 40 {
+		status.EnableGeneration = binary.LittleEndian.Uint64(data[32:40])
+	}
+	return status, nil
+}
+
+// EnableQuota enables quotas on the Btrfs filesystem the given path is located on.
+// With simple set, simple quotas (squota, Linux 6.7+) are enabled instead of full qgroup accounting.
+// Enabling quotas on a filesystem that already has quotas enabled is a no-op.
+func EnableQuota(path string, simple bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	args := quotaCtlArgs{cmd: quotaCtlEnable}
+	if simple {
+		args.cmd = quotaCtlEnableSimpleQuota
+	}
+	if err := ioctl(f.Fd(), iocQuotaCtl, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("failed to enable quotas on %s: %w", path, err)
+	}
+	return nil
+}
+
+// GetQgroupInfo returns the accounting information of the qgroup of the subvolume at the given path
+func GetQgroupInfo(path string) (QgroupInfo, error) {
+	info := QgroupInfo{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	// The level 0 qgroup ID is the subvolume ID
+	info.ID, err = subvolumeID(f)
+	if err != nil {
+		return info, err
+	}
+
+	items, err := treeSearch(f, quotaTreeObjectID, 0, qgroupInfoKey, info.ID)
+	if errors.Is(err, unix.ENOENT) {
+		return info, ErrQuotaDisabled
+	}
+	if err != nil {
+		return info, fmt.Errorf("failed to get qgroup info of %s: %w", path, err)
+	}
+	if len(items) == 0 {
+		return info, fmt.Errorf("no qgroup found for subvolume %s", path)
+	}
+
+	// struct btrfs_qgroup_info_item: generation, rfer, rfer_cmpr, excl, excl_cmpr
+	data := items[0].data
+	if len(data) < 40 {
+		return info, fmt.Errorf("invalid qgroup info item of size %d", len(data))
+	}
+	info.Referenced = int64(binary.LittleEndian.Uint64(data[8:16]))
+	info.Exclusive = int64(binary.LittleEndian.Uint64(data[24:32]))
+
+	items, err = treeSearch(f, quotaTreeObjectID, 0, qgroupLimitKey, info.ID)
+	if err != nil {
+		return info, fmt.Errorf("failed to get qgroup limit of %s: %w", path, err)
+	}
+	if len(items) == 0 {
+		return info, nil
+	}
+
+	// struct btrfs_qgroup_limit_item: flags, max_rfer, max_excl, rsv_rfer, rsv_excl
+	data = items[0].data
+	if len(data) < 24 {
+		return info, fmt.Errorf("invalid qgroup limit item of size %d", len(data))
+	}
+	flags := binary.LittleEndian.Uint64(data[0:8])
+	info.MaxReferenced = limitValue(flags&qgroupLimitMaxReferenced != 0, binary.LittleEndian.Uint64(data[8:16]))
+	info.MaxExclusive = limitValue(flags&qgroupLimitMaxExclusive != 0, binary.LittleEndian.Uint64(data[16:24]))
+	return info, nil
+}
+
+// SetQgroupLimit limits the referenced bytes of the subvolume at the given path
+func SetQgroupLimit(path string, maxReferenced int64) error {
+	return setQgroupLimit(path, qgroupLimit{
+		flags:         qgroupLimitMaxReferenced,
+		maxReferenced: uint64(maxReferenced),
+	})
+}
+
+// SetQgroupExclusiveLimit limits the exclusive bytes of the subvolume at the given path,
+// i.e. the bytes that are not shared with other subvolumes
+func SetQgroupExclusiveLimit(path string, maxExclusive int64) error {
+	return setQgroupLimit(path, qgroupLimit{
+		flags:        qgroupLimitMaxExclusive,
+		maxExclusive: uint64(maxExclusive),
+	})
+}
+
+func setQgroupLimit(path string, limit qgroupLimit) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// qgroup ID 0 refers to the subvolume of the file descriptor
+	args := qgroupLimitArgs{limit: limit}
+	if err := ioctl(f.Fd(), iocQgroupLimit, unsafe.Pointer(&args)); err != nil {
+		if errors.Is(err, unix.ENOTCONN) {
+			return ErrQuotaDisabled
+		}
+		return fmt.Errorf("failed to set qgroup limit of %s: %w", path, err)
+	}
+	return nil
+}
+
+// limitValue converts an on-disk qgroup limit to bytes, 0 meaning unlimited
+func limitValue(set bool, value uint64) int64 {
+	if !set || value == math.MaxUint64 {
+		return 0
+	}
+	return int64(value)
+}
+
+// treeSearch returns the items with exactly the given key from the given tree
+func treeSearch(f *os.File, treeID, objectID uint64, typ uint32, offset uint64) ([]searchItem, error) {
+	args := searchArgs{
+		key: searchKey{
+			treeID:      treeID,
+			minObjectID: objectID,
+			maxObjectID: objectID,
+			minType:     typ,
+			maxType:     typ,
+			minOffset:   offset,
+			maxOffset:   offset,
+			maxTransID:  math.MaxUint64,
+			nrItems:     1,
+		},
+	}
+	if err := ioctl(f.Fd(), iocTreeSearch, unsafe.Pointer(&args)); err != nil {
+		return nil, err
+	}
+	return parseSearchItems(&args), nil
+}
+
+// parseSearchItems returns the items found by a tree search
+func parseSearchItems(args *searchArgs) []searchItem {
+	items := make([]searchItem, 0, args.key.nrItems)
+	pos := 0
+	for i := uint32(0); i < args.key.nrItems; i++ {
+		if pos+int(unsafe.Sizeof(searchHeader{})) > len(args.buf) {
+			break
+		}
+		header := (*searchHeader)(unsafe.Pointer(&args.buf[pos]))
+		pos += int(unsafe.Sizeof(searchHeader{}))
+		if pos+int(header.len) > len(args.buf) {
+			break
+		}
+		data := make([]byte, header.len)
+		copy(data, args.buf[pos:pos+int(header.len)])
+		pos += int(header.len)
+
+		items = append(items, searchItem{
+			objectID: header.objectID,
+			offset:   header.offset,
+			typ:      header.typ,
+			data:     data,
+		})
+	}
+	return items
+}
@@ -0,0 +1,25 @@
+package btrfs
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLimitValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		set      bool
+		value    uint64
+		expected int64
+	}{
+		{name: "not set", value: 4096, expected: 0},
+		{name: "set", set: true, value: 4096, expected: 4096},
+		{name: "unlimited", set: true, value: math.MaxUint64, expected: 0},
+	}
+
+	for _, tt := range tests {
+		if limit := limitValue(tt.set, tt.value); limit != tt.expected {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.expected, limit)
+		}
+	}
+}
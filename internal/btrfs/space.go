@@ -0,0 +1,189 @@
+package btrfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// block group types and profiles of struct btrfs_ioctl_space_info
+	blockGroupData     = 1 << 0
+	blockGroupSystem   = 1 << 1
+	blockGroupMetadata = 1 << 2
+	blockGroupRaid0    = 1 << 3
+	blockGroupRaid1    = 1 << 4
+	blockGroupDup      = 1 << 5
+	blockGroupRaid10   = 1 << 6
+	blockGroupRaid5    = 1 << 7
+	blockGroupRaid6    = 1 << 8
+	blockGroupRaid1C3  = 1 << 9
+	blockGroupRaid1C4  = 1 << 10
+	spaceInfoGlobalRsv = 1 << 49
+
+	// unallocated space below this threshold is not counted as free, like btrfs-progs does
+	minUnallocatedThreshold = 16 << 20
+)
+
+// spaceInfo is a struct btrfs_ioctl_space_info
+type spaceInfo struct {
+	flags      uint64
+	totalBytes uint64
+	usedBytes  uint64
+}
+
+// FilesystemUsage contains the allocation of a Btrfs filesystem, like "btrfs filesystem usage"
+type FilesystemUsage struct {
+	DeviceSize        int64   // size of all devices in bytes
+	DeviceAllocated   int64   // bytes allocated to chunks on the devices
+	DeviceUnallocated int64   // bytes not allocated to chunks
+	Used              int64   // bytes used by data and metadata on the devices
+	FreeEstimated     int64   // estimated free bytes for data
+	FreeEstimatedMin  int64   // estimated free bytes if the unallocated space gets the most redundant profile in use
+	FreeStatfs        int64   // free bytes reported by statfs (df)
+	DataRatio         float64 // bytes on the devices per byte of data
+	MetadataRatio     float64 // bytes on the devices per byte of metadata
+	GlobalReserve     int64   // bytes of the global metadata reserve
+	GlobalReserveUsed int64   // bytes of the global metadata reserve in use
+}
+
+// GetFilesystemUsage returns the allocation of the Btrfs filesystem the given path is located on
+func GetFilesystemUsage(path string) (FilesystemUsage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FilesystemUsage{}, err
+	}
+	defer f.Close()
+
+	fsInfo := fsInfoArgs{}
+	if err := ioctl(f.Fd(), iocFsInfo, unsafe.Pointer(&fsInfo)); err != nil {
+		return FilesystemUsage{}, fmt.Errorf("failed to get filesystem info of %s: %w", path, err)
+	}
+
+	var deviceSize uint64
+	for devid := uint64(1); devid <= fsInfo.maxID; devid++ {
+		devInfo := devInfoArgs{devid: devid}
+		if err := ioctl(f.Fd(), iocDevInfo, unsafe.Pointer(&devInfo)); err != nil {
+			// Device IDs of removed devices are not reused
+			if errors.Is(err, unix.ENODEV) {
+				continue
+			}
+			return FilesystemUsage{}, fmt.Errorf("failed to get info of device %d of %s: %w", devid, path, err)
+		}
+		deviceSize += devInfo.totalBytes
+	}
+
+	spaces, err := getSpaceInfo(f)
+	if err != nil {
+		return FilesystemUsage{}, fmt.Errorf("failed to get space info of %s: %w", path, err)
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Fstatfs(int(f.Fd()), &statfs); err != nil {
+		return FilesystemUsage{}, fmt.Errorf("failed to stat filesystem of %s: %w", path, err)
+	}
+
+	usage := computeUsage(deviceSize, fsInfo.numDevices, spaces)
+	usage.FreeStatfs = int64(statfs.Bavail) * statfs.Bsize
+	return usage, nil
+}
+
+// getSpaceInfo returns the allocation of each block group type and profile of the filesystem
+func getSpaceInfo(f *os.File) ([]spaceInfo, error) {
+	// struct btrfs_ioctl_space_args is followed by the space infos, which are counted by a first call without slots
+	header := [2]uint64{}
+	if err := ioctl(f.Fd(), iocSpaceInfo, unsafe.Pointer(&header)); err != nil {
+		return nil, err
+	}
+	slots := header[1]
+	if slots == 0 {
+		return nil, nil
+	}
+
+	buf := make([]uint64, 2+3*slots)
+	buf[0] = slots
+	if err := ioctl(f.Fd(), iocSpaceInfo, unsafe.Pointer(&buf[0])); err != nil {
+		return nil, err
+	}
+
+	spaces := make([]spaceInfo, 0, buf[1])
+	for i := uint64(0); i < buf[1] && i < slots; i++ {
+		spaces = append(spaces, spaceInfo{flags: buf[2+3*i], totalBytes: buf[3+3*i], usedBytes: buf[4+3*i]})
+	}
+	return spaces, nil
+}
+
+// profileRatio returns the bytes on the devices per byte stored with the profile of the given block group flags
+func profileRatio(flags, numDevices uint64) float64 {
+	switch {
+	case flags&(blockGroupRaid1|blockGroupDup|blockGroupRaid10) != 0:
+		return 2
+	case flags&blockGroupRaid1C3 != 0:
+		return 3
+	case flags&blockGroupRaid1C4 != 0:
+		return 4
+	case flags&blockGroupRaid5 != 0 && numDevices > 1:
+		return float64(numDevices) / float64(numDevices-1)
+	case flags&blockGroupRaid6 != 0 && numDevices > 2:
+		return float64(numDevices) / float64(numDevices-2)
+	default:
+		// single and RAID0
+		return 1
+	}
+}
+
+// computeUsage computes the filesystem usage from the size of the devices and the space infos,
+// estimating the free space the same way as btrfs-progs
+func computeUsage(deviceSize, numDevices uint64, spaces []spaceInfo) FilesystemUsage {
+	usage := FilesystemUsage{DeviceSize: int64(deviceSize)}
+
+	var rawAllocated, rawUsed, dataTotal, dataUsed, rawData, metadataTotal, rawMetadata float64
+	maxDataRatio := 1.0
+	for _, space := range spaces {
+		if space.flags&spaceInfoGlobalRsv != 0 {
+			usage.GlobalReserve = int64(space.totalBytes)
+			usage.GlobalReserveUsed = int64(space.usedBytes)
+			continue
+		}
+
+		ratio := profileRatio(space.flags, numDevices)
+		rawAllocated += float64(space.totalBytes) * ratio
+		rawUsed += float64(space.usedBytes) * ratio
+		if space.flags&blockGroupData != 0 {
+			dataTotal += float64(space.totalBytes)
+			dataUsed += float64(space.usedBytes)
+			rawData += float64(space.totalBytes) * ratio
+			maxDataRatio = max(maxDataRatio, ratio)
+		}
+		if space.flags&blockGroupMetadata != 0 {
+			metadataTotal += float64(space.totalBytes)
+			rawMetadata += float64(space.totalBytes) * ratio
+		}
+	}
+
+	usage.DataRatio = 1
+	if dataTotal > 0 {
+		usage.DataRatio = rawData / dataTotal
+	}
+	usage.MetadataRatio = 1
+	if metadataTotal > 0 {
+		usage.MetadataRatio = rawMetadata / metadataTotal
+	}
+
+	usage.DeviceAllocated = int64(rawAllocated)
+	usage.DeviceUnallocated = max(usage.DeviceSize-usage.DeviceAllocated, 0)
+	usage.Used = int64(rawUsed)
+
+	// Free space in the allocated data chunks, plus the data that fits into the unallocated space
+	free := dataTotal - dataUsed
+	usage.FreeEstimated = int64(free)
+	usage.FreeEstimatedMin = int64(free)
+	if usage.DeviceUnallocated >= minUnallocatedThreshold {
+		usage.FreeEstimated += int64(float64(usage.DeviceUnallocated) / usage.DataRatio)
+		usage.FreeEstimatedMin += int64(float64(usage.DeviceUnallocated) / maxDataRatio)
+	}
+	return usage
+}
@@ -0,0 +1,92 @@
+package btrfs
+
+import "testing"
+
+// TestComputeUsage verifies the usage and free space estimate of single and RAID1 filesystems
+func TestComputeUsage(t *testing.T) {
+	const mib = 1 << 20
+
+	tests := []struct {
+		name          string
+		deviceSize    uint64
+		numDevices    uint64
+		spaces        []spaceInfo
+		expected      FilesystemUsage
+		dataRatio     float64
+		metadataRatio float64
+	}{
+		{
+			name:       "single data with DUP metadata",
+			deviceSize: 10240 * mib,
+			numDevices: 1,
+			spaces: []spaceInfo{
+				{flags: blockGroupData, totalBytes: 1024 * mib, usedBytes: 512 * mib},
+				{flags: blockGroupSystem | blockGroupDup, totalBytes: 8 * mib, usedBytes: 16 << 10},
+				{flags: blockGroupMetadata | blockGroupDup, totalBytes: 256 * mib, usedBytes: 64 * mib},
+				{flags: spaceInfoGlobalRsv, totalBytes: 16 * mib},
+			},
+			expected: FilesystemUsage{
+				DeviceSize:        10240 * mib,
+				DeviceAllocated:   1552 * mib,
+				DeviceUnallocated: 8688 * mib,
+				Used:              640*mib + 32<<10,
+				FreeEstimated:     9200 * mib,
+				FreeEstimatedMin:  9200 * mib,
+				GlobalReserve:     16 * mib,
+			},
+			dataRatio:     1,
+			metadataRatio: 2,
+		},
+		{
+			name:       "RAID1 data and metadata",
+			deviceSize: 20480 * mib,
+			numDevices: 2,
+			spaces: []spaceInfo{
+				{flags: blockGroupData | blockGroupRaid1, totalBytes: 1024 * mib, usedBytes: 256 * mib},
+				{flags: blockGroupMetadata | blockGroupRaid1, totalBytes: 256 * mib, usedBytes: 16 * mib},
+			},
+			expected: FilesystemUsage{
+				DeviceSize:        20480 * mib,
+				DeviceAllocated:   2560 * mib,
+				DeviceUnallocated: 17920 * mib,
+				Used:              544 * mib,
+				FreeEstimated:     9728 * mib,
+				FreeEstimatedMin:  9728 * mib,
+			},
+			dataRatio:     2,
+			metadataRatio: 2,
+		},
+		{
+			name:       "full filesystem",
+			deviceSize: 1024 * mib,
+			numDevices: 1,
+			spaces: []spaceInfo{
+				{flags: blockGroupData, totalBytes: 1016 * mib, usedBytes: 1000 * mib},
+			},
+			expected: FilesystemUsage{
+				DeviceSize:        1024 * mib,
+				DeviceAllocated:   1016 * mib,
+				DeviceUnallocated: 8 * mib,
+				Used:              1000 * mib,
+				FreeEstimated:     16 * mib,
+				FreeEstimatedMin:  16 * mib,
+			},
+			dataRatio:     1,
+			metadataRatio: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := computeUsage(tt.deviceSize, tt.numDevices, tt.spaces)
+			if usage.DataRatio != tt.dataRatio || usage.MetadataRatio != tt.metadataRatio {
+				t.Errorf("Expected data ratio %.2f and metadata ratio %.2f, got %.2f and %.2f",
+					tt.dataRatio, tt.metadataRatio, usage.DataRatio, usage.MetadataRatio)
+			}
+			usage.DataRatio, usage.MetadataRatio = 0, 0
+			if usage != tt.expected {
+				t.Errorf("Expected usage %+v, got %+v", tt.expected, usage)
+			}
+		})
+	}
+}
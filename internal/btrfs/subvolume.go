@@ -0,0 +1,269 @@
+// Package btrfs implements Btrfs subvolume, snapshot and quota management
+// directly through the kernel's ioctl interface, without requiring btrfs-progs.
+package btrfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrSubvolumeNotFound is returned when a subvolume ID does not exist on a filesystem
+var ErrSubvolumeNotFound = errors.New("subvolume does not exist")
+
+// SubvolumeInfo contains information about a Btrfs subvolume
+type SubvolumeInfo struct {
+	ID           uint64
+	Name         string
+	UUID         string
+	ParentUUID   string // UUID of the subvolume this one was snapshotted from (empty if none)
+	CreationTime time.Time
+	Generation   uint64 // transaction in which the subvolume was created
+	LastChange   uint64 // last transaction that changed the subvolume
+	ReadOnly     bool
+}
+
+// FilesystemInfo contains information about a Btrfs filesystem
+type FilesystemInfo struct {
+	UUID       string
+	NumDevices uint64
+	NodeSize   uint32
+	SectorSize uint32
+}
+
+// IsBtrfs checks if the given path is located on a Btrfs filesystem
+func IsBtrfs(path string) (bool, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return false, err
+	}
+	return stat.Type == unix.BTRFS_SUPER_MAGIC, nil
+}
+
+// IsSubvolume checks if the given path is the root of a Btrfs subvolume
+func IsSubvolume(path string) (bool, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err != nil {
+		return false, err
+	}
+	// The root directory of every subvolume has the first free inode number
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR || stat.Ino != firstFreeObject {
+		return false, nil
+	}
+	return IsBtrfs(path)
+}
+
+// CreateSubvolume creates a new, empty subvolume at the given path
+func CreateSubvolume(path string) error {
+	parent, name, err := openParent(path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	args := volArgs{}
+	copy(args.name[:], name)
+	if err := ioctl(parent.Fd(), iocSubvolCreate, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("failed to create subvolume %s: %w", path, err)
+	}
+	return nil
+}
+
+// CreateSnapshot creates a snapshot of the source subvolume at the given path
+func CreateSnapshot(sourcePath, path string, readOnly bool) error {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	parent, name, err := openParent(path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	args := volArgsV2{fd: int64(source.Fd())}
+	if readOnly {
+		args.flags |= subvolReadOnly
+	}
+	copy(args.name[:], name)
+	if err := ioctl(parent.Fd(), iocSnapCreateV2, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("failed to create snapshot %s of subvolume %s: %w", path, sourcePath, err)
+	}
+	return nil
+}
+
+// DeleteSubvolume deletes the subvolume (or snapshot) at the given path
+func DeleteSubvolume(path string) error {
+	parent, name, err := openParent(path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	args := volArgs{}
+	copy(args.name[:], name)
+	if err := ioctl(parent.Fd(), iocSnapDestroy, unsafe.Pointer(&args)); err != nil {
+		return fmt.Errorf("failed to delete subvolume %s: %w", path, err)
+	}
+	return nil
+}
+
+// GetSubvolumeID returns the ID of the subvolume containing the given path
+func GetSubvolumeID(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return subvolumeID(f)
+}
+
+// GetSubvolumeInfo returns information about the subvolume at the given path
+func GetSubvolumeInfo(path string) (SubvolumeInfo, error) {
+	info := SubvolumeInfo{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	args := getSubvolInfoArgs{}
+	if err := ioctl(f.Fd(), iocGetSubvolInfo, unsafe.Pointer(&args)); err != nil {
+		return info, fmt.Errorf("failed to get info of subvolume %s: %w", path, err)
+	}
+
+	var flags uint64
+	if err := ioctl(f.Fd(), iocSubvolGetFlag, unsafe.Pointer(&flags)); err != nil {
+		return info, fmt.Errorf("failed to get flags of subvolume %s: %w", path, err)
+	}
+
+	info.ID = args.treeID
+	info.Name = string(bytes.TrimRight(args.name[:], "\x00"))
+	info.UUID = formatUUID(args.uuid)
+	info.ParentUUID = formatUUID(args.parentUUID)
+	info.CreationTime = time.Unix(int64(args.otime.sec), int64(args.otime.nsec))
+	info.Generation = args.otransid
+	info.LastChange = args.generation
+	info.ReadOnly = flags&subvolReadOnly != 0
+	return info, nil
+}
+
+// GetSubvolumeName returns the name of the subvolume with the given ID on the Btrfs filesystem
+// the given path is located on, i.e. the name of its directory entry in the parent directory.
+// It returns ErrSubvolumeNotFound if there is no such subvolume.
+func GetSubvolumeName(path string, subvolumeID uint64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// The root tree has a backref from each subvolume to the subvolume containing it
+	args := searchArgs{
+		key: searchKey{
+			treeID:      rootTreeObjectID,
+			minObjectID: subvolumeID,
+			maxObjectID: subvolumeID,
+			minType:     rootBackrefKey,
+			maxType:     rootBackrefKey,
+			maxOffset:   math.MaxUint64,
+			maxTransID:  math.MaxUint64,
+			nrItems:     1,
+		},
+	}
+	if err := ioctl(f.Fd(), iocTreeSearch, unsafe.Pointer(&args)); err != nil {
+		return "", fmt.Errorf("failed to look up subvolume %d on %s: %w", subvolumeID, path, err)
+	}
+	items := parseSearchItems(&args)
+	if len(items) == 0 || items[0].typ != rootBackrefKey {
+		return "", fmt.Errorf("%w: %d", ErrSubvolumeNotFound, subvolumeID)
+	}
+
+	name, err := parseRootRef(items[0].data)
+	if err != nil {
+		return "", fmt.Errorf("invalid backref of subvolume %d: %w", subvolumeID, err)
+	}
+	return name, nil
+}
+
+// parseRootRef returns the name of a struct btrfs_root_ref: dirid, sequence and name_len, followed by the name
+func parseRootRef(data []byte) (string, error) {
+	const headerSize = 18
+	if len(data) < headerSize {
+		return "", fmt.Errorf("root ref of size %d is too short", len(data))
+	}
+	nameLen := int(binary.LittleEndian.Uint16(data[16:18]))
+	if len(data) < headerSize+nameLen {
+		return "", fmt.Errorf("root ref of size %d is too short for a name of %d bytes", len(data), nameLen)
+	}
+	return string(data[headerSize : headerSize+nameLen]), nil
+}
+
+// GetFilesystemInfo returns information about the Btrfs filesystem the given path is located on
+func GetFilesystemInfo(path string) (FilesystemInfo, error) {
+	info := FilesystemInfo{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+
+	args := fsInfoArgs{}
+	if err := ioctl(f.Fd(), iocFsInfo, unsafe.Pointer(&args)); err != nil {
+		return info, fmt.Errorf("failed to get filesystem info of %s: %w", path, err)
+	}
+
+	info.UUID = formatUUID(args.fsid)
+	info.NumDevices = args.numDevices
+	info.NodeSize = args.nodesize
+	info.SectorSize = args.sectorsize
+	return info, nil
+}
+
+// subvolumeID looks up the ID of the subvolume the open file belongs to
+func subvolumeID(f *os.File) (uint64, error) {
+	args := inoLookupArgs{objectid: firstFreeObject}
+	if err := ioctl(f.Fd(), iocInoLookup, unsafe.Pointer(&args)); err != nil {
+		return 0, fmt.Errorf("failed to look up subvolume ID of %s: %w", f.Name(), err)
+	}
+	return args.treeid, nil
+}
+
+// openParent opens the parent directory of the given path and returns it along with the base name
+func openParent(path string) (*os.File, string, error) {
+	path = filepath.Clean(path)
+	name := filepath.Base(path)
+	if name == "/" || name == "." || name == ".." {
+		return nil, "", fmt.Errorf("invalid subvolume path %s", path)
+	}
+	if len(name) > volNameMax {
+		return nil, "", fmt.Errorf("subvolume name %s is too long", name)
+	}
+
+	parent, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return nil, "", err
+	}
+	return parent, name, nil
+}
+
+// formatUUID formats a binary UUID in its canonical string representation (empty if all zeros)
+func formatUUID(uuid [uuidSize]byte) string {
+	if uuid == [uuidSize]byte{} {
+		return ""
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16])
+}
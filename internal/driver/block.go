@@ -0,0 +1,281 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/btrfs-csi/driver/internal/btrfs"
+	"github.com/btrfs-csi/driver/internal/loop"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// blockImageName is the name of the image file that backs a raw block volume inside its subvolume
+const blockImageName = "disk.img"
+
+// loopDevice is a loop device an image file is attached to
+type loopDevice struct {
+	Path     string // e.g. /dev/loop0
+	ReadOnly bool
+}
+
+// isBlockVolumeRequest returns whether any of the requested volume capabilities is a raw block volume
+func isBlockVolumeRequest(capabilities []*csi.VolumeCapability) bool {
+	for _, capability := range capabilities {
+		if capability.GetBlock() != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// blockImagePath returns the path of the image file of a raw block volume
+func blockImagePath(subvolumePath string) string {
+	return filepath.Join(subvolumePath, blockImageName)
+}
+
+// isBlockVolume returns whether the given volume or snapshot is a raw block volume
+func (d *BtrfsDriver) isBlockVolume(subvolumePath string) bool {
+	metadata, err := d.readVolumeMetadata(subvolumePath)
+	if err == nil && metadata != nil {
+		return metadata.Block
+	}
+	_, err = os.Stat(hostPath(blockImagePath(subvolumePath)))
+	return err == nil
+}
+
+// createBlockImage creates the image file of a raw block volume in the given subvolume.
+// Copy-on-write is disabled for the image, so that random writes of file systems
+// and databases inside the volume do not fragment it.
+func createBlockImage(subvolumePath string, size int64, preallocate bool) error {
+	imagePath := hostPath(blockImagePath(subvolumePath))
+	f, err := os.OpenFile(imagePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create image file: %v", err)
+	}
+	defer f.Close()
+
+	// Copy-on-write can only be disabled while the file is still empty
+	start := time.Now()
+	err = btrfs.SetNoCOW(imagePath)
+	observeOperation("attribute set", start, err)
+	if err != nil {
+		return err
+	}
+	if err := allocateBlockImage(f, size, preallocate); err != nil {
+		return err
+	}
+
+	klog.Infof("Created image %s with %d bytes (preallocated: %t)", blockImagePath(subvolumePath), size, preallocate)
+	return nil
+}
+
+// resizeBlockImage grows the image file of a raw block volume to the given size.
+// Images are never shrunk, since that would truncate the data of the volume.
+func resizeBlockImage(subvolumePath string, size int64, preallocate bool) error {
+	f, err := os.OpenFile(hostPath(blockImagePath(subvolumePath)), os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open image file: %v", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get size of image file: %v", err)
+	}
+	if info.Size() >= size {
+		return nil
+	}
+	if err := allocateBlockImage(f, size, preallocate); err != nil {
+		return err
+	}
+
+	klog.Infof("Resized image %s from %d to %d bytes", blockImagePath(subvolumePath), info.Size(), size)
+	return nil
+}
+
+// allocateBlockImage sets the size of an image file, either as a sparse file or fully allocated
+func allocateBlockImage(f *os.File, size int64, preallocate bool) error {
+	if preallocate {
+		if err := unix.Fallocate(int(f.Fd()), 0, 0, size); err != nil {
+			return fmt.Errorf("failed to allocate %d bytes for image file: %v", size, err)
+		}
+		return nil
+	}
+	if err := f.Truncate(size); err != nil {
+		return fmt.Errorf("failed to resize image file to %d bytes: %v", size, err)
+	}
+	return nil
+}
+
+// getBlockImageUsage returns the size of the image file of a raw block volume
+// and the bytes that are actually allocated for it
+func getBlockImageUsage(subvolumePath string) (int64, int64, error) {
+	info, err := os.Stat(hostPath(blockImagePath(subvolumePath)))
+	if err != nil {
+		return 0, 0, err
+	}
+	allocated := info.Size()
+	if stat, ok := info.Sys().(*unix.Stat_t); ok {
+		allocated = stat.Blocks * 512
+	}
+	return info.Size(), allocated, nil
+}
+
+// findLoopDevices returns the loop devices the image file of a raw block volume is attached to
+func findLoopDevices(subvolumePath string) ([]loopDevice, error) {
+	start := time.Now()
+	attached, err := loop.Find(hostPath("/dev"), hostPath(blockImagePath(subvolumePath)))
+	observeOperation("loop find", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list loop devices: %v", err)
+	}
+
+	devices := []loopDevice{}
+	for _, device := range attached {
+		devices = append(devices, newLoopDevice(device))
+	}
+	return devices, nil
+}
+
+// newLoopDevice returns the loop device with its path on the host
+func newLoopDevice(device loop.Device) loopDevice {
+	return loopDevice{Path: filepath.Join("/dev", filepath.Base(device.Path)), ReadOnly: device.ReadOnly}
+}
+
+// attachLoopDevice attaches the image file of a raw block volume to a new loop device
+func attachLoopDevice(subvolumePath string, readOnly bool) (loopDevice, error) {
+	start := time.Now()
+	attached, err := loop.Attach(hostPath("/dev"), hostPath(blockImagePath(subvolumePath)), readOnly)
+	observeOperation("loop attach", start, err)
+	if err != nil {
+		return loopDevice{}, fmt.Errorf("failed to attach loop device: %v", err)
+	}
+	device := newLoopDevice(attached)
+	klog.Infof("Attached image %s to loop device %s (read-only: %t)", blockImagePath(subvolumePath), device.Path, device.ReadOnly)
+	return device, nil
+}
+
+// detachLoopDevice detaches a loop device from its image file
+func detachLoopDevice(device loopDevice) error {
+	start := time.Now()
+	err := loop.Detach(hostPath(device.Path))
+	observeOperation("loop detach", start, err)
+	if err != nil {
+		return err
+	}
+	klog.Infof("Detached loop device %s", device.Path)
+	return nil
+}
+
+// refreshLoopDevice updates the capacity of a loop device after its image file was resized
+func refreshLoopDevice(device loopDevice) error {
+	start := time.Now()
+	err := loop.SetCapacity(hostPath(device.Path))
+	observeOperation("loop set-capacity", start, err)
+	return err
+}
+
+// publishBlockVolume attaches the image of a raw block volume to a loop device
+// and bind mounts the device to the target path on the host
+func (d *BtrfsDriver) publishBlockVolume(subvolumePath, targetPath string, readOnly bool) error {
+	devices, err := findLoopDevices(subvolumePath)
+	if err != nil {
+		return err
+	}
+
+	// Device nodes can be written through read-only mounts,
+	// therefore read-only publishes need a read-only loop device
+	var device *loopDevice
+	for i := range devices {
+		if devices[i].ReadOnly == readOnly {
+			device = &devices[i]
+			break
+		}
+	}
+	if device == nil {
+		attached, err := attachLoopDevice(subvolumePath, readOnly)
+		if err != nil {
+			return err
+		}
+		device = &attached
+	}
+
+	// The target path of a raw block volume is a file the device is bind mounted to
+	target := hostPath(targetPath)
+	if err := os.MkdirAll(filepath.Dir(target), 0750); err != nil {
+		return fmt.Errorf("failed to create parent directory of %s: %v", targetPath, err)
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create target file %s: %v", targetPath, err)
+	}
+	f.Close()
+
+	options := mountOptions{}
+	if readOnly {
+		options.flags = unix.MS_RDONLY
+	}
+	if err := bindMount(hostPath(device.Path), targetPath, options); err != nil {
+		return err
+	}
+
+	klog.Infof("Mounted loop device %s of volume %s to %s", device.Path, subvolumePath, targetPath)
+	return nil
+}
+
+// detachUnusedLoopDevices detaches the loop devices of a raw block volume which are not mounted anymore
+func (d *BtrfsDriver) detachUnusedLoopDevices(subvolumePath string) error {
+	devices, err := findLoopDevices(subvolumePath)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		mounted, err := isDeviceMounted(device.Path)
+		if err != nil {
+			return err
+		}
+		if mounted {
+			continue
+		}
+		if err := detachLoopDevice(device); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isSameDevice checks if the target path is the given device node (or a bind mount of it)
+func isSameDevice(devicePath, targetPath string) (bool, error) {
+	var device, target unix.Stat_t
+	if err := unix.Stat(hostPath(devicePath), &device); err != nil {
+		return false, err
+	}
+	if err := unix.Stat(hostPath(targetPath), &target); err != nil {
+		return false, err
+	}
+	return target.Mode&unix.S_IFMT == unix.S_IFBLK && target.Rdev == device.Rdev, nil
+}
+
+// isBlockVolumePublished checks if the target path is a bind mount of a loop device of the given raw block volume
+func (d *BtrfsDriver) isBlockVolumePublished(subvolumePath, targetPath string) (bool, error) {
+	devices, err := findLoopDevices(subvolumePath)
+	if err != nil {
+		return false, err
+	}
+	for _, device := range devices {
+		same, err := isSameDevice(device.Path, targetPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+		if same {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,30 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/btrfs-csi/driver/internal/loop"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestIsBlockVolumeRequest(t *testing.T) {
+	mount := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+	block := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+
+	if isBlockVolumeRequest(nil) {
+		t.Error("Expected no block volume without capabilities")
+	}
+	if isBlockVolumeRequest([]*csi.VolumeCapability{mount}) {
+		t.Error("Expected no block volume for mount capability")
+	}
+	if !isBlockVolumeRequest([]*csi.VolumeCapability{block}) {
+		t.Error("Expected block volume for block capability")
+	}
+}
+
+func TestNewLoopDevice(t *testing.T) {
+	device := newLoopDevice(loop.Device{Path: "/host/dev/loop3", ReadOnly: true, BackingDevice: 42, BackingInode: 257})
+	if device != (loopDevice{Path: "/dev/loop3", ReadOnly: true}) {
+		t.Errorf("Unexpected loop device %+v", device)
+	}
+}
@@ -1,13 +1,16 @@
 package driver
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strconv"
-	"strings"
+	"sort"
+	"time"
 
+	"github.com/btrfs-csi/driver/internal/btrfs"
+	"golang.org/x/sys/unix"
 	"k8s.io/klog/v2"
 )
 
@@ -17,6 +20,8 @@ const (
 	DefaultBtrfsPath = "/var/lib/btrfs-csi"
 	// DefaultQuotaSize is the default quota size if not specified (1GB)
 	DefaultQuotaSize = 1073741824 // 1GB in bytes
+	// defaultSectorSize is the sector size assumed if the sector size of a filesystem cannot be determined
+	defaultSectorSize = 4096
 )
 
 // BtrfsManager handles Btrfs subvolume operations
@@ -28,270 +33,598 @@ func NewBtrfsManager() *BtrfsManager {
 	return &BtrfsManager{}
 }
 
+// hostRoot is the path under which the host filesystem is mounted in the container
+const hostRoot = "/host"
+
+// hostPath returns the path under which a path of the host filesystem is accessible in the container
+func hostPath(path string) string {
+	return filepath.Join(hostRoot, path)
+}
+
 // createBtrfsSubvolume creates a new Btrfs subvolume with quota
-func (d *BtrfsDriver) createBtrfsSubvolume(subvolumePath string, sizeBytes int64) error {
-	// Check if subvolume already exists
-	if _, err := os.Stat(filepath.Join("/host", subvolumePath)); err == nil {
-		klog.Infof("Subvolume %s already exists", subvolumePath)
+func (d *BtrfsDriver) createBtrfsSubvolume(subvolumePath string, sizeBytes int64, params volumeParameters) error {
+	// Create the subvolume
+	start := time.Now()
+	err := btrfs.CreateSubvolume(hostPath(subvolumePath))
+	observeOperation("subvolume create", start, err)
+	if err != nil {
+		return fmt.Errorf("failed to create btrfs subvolume: %v", err)
+	}
+
+	klog.Infof("Created btrfs subvolume: %s", subvolumePath)
+
+	if err := d.setSubvolumeAttributes(subvolumePath, params); err != nil {
+		d.deleteIncompleteSubvolume(subvolumePath)
+		return err
+	}
+
+	if params.Block {
+		if err := createBlockImage(subvolumePath, sizeBytes, params.Preallocate); err != nil {
+			d.deleteIncompleteSubvolume(subvolumePath)
+			return err
+		}
+	}
+
+	return d.setInitialSubvolumeQuota(subvolumePath, sizeBytes, params)
+}
+
+// createBtrfsSubvolumeFromSource creates a new writable Btrfs subvolume with quota
+// as a copy-on-write copy of an existing subvolume or snapshot
+func (d *BtrfsDriver) createBtrfsSubvolumeFromSource(sourcePath, subvolumePath string, sizeBytes int64, params volumeParameters) error {
+	// Create a writable snapshot of the source
+	if err := d.createBtrfsSnapshot(sourcePath, subvolumePath, false); err != nil {
+		return err
+	}
+
+	// Existing files keep the attributes of the source, only new files get the requested attributes
+	if err := d.setSubvolumeAttributes(subvolumePath, params); err != nil {
+		d.deleteIncompleteSubvolume(subvolumePath)
+		return err
+	}
+
+	if params.Block {
+		if err := resizeBlockImage(subvolumePath, sizeBytes, params.Preallocate); err != nil {
+			d.deleteIncompleteSubvolume(subvolumePath)
+			return err
+		}
+	}
+
+	return d.setInitialSubvolumeQuota(subvolumePath, sizeBytes, params)
+}
+
+// setInitialSubvolumeQuota sets the quota of a newly created subvolume if size is specified.
+// If quotas are required and the quota cannot be set, the subvolume is deleted again.
+func (d *BtrfsDriver) setInitialSubvolumeQuota(subvolumePath string, sizeBytes int64, params volumeParameters) error {
+	if sizeBytes <= 0 || params.QuotaMode == QuotaModeNone {
+		return nil
+	}
+	err := d.setSubvolumeQuota(subvolumePath, sizeBytes, params.QuotaMode)
+	if err == nil {
 		return nil
 	}
 
-	// Create the subvolume
-	cmd := execWithLog("chroot", "/host", "btrfs", "subvolume", "create", subvolumePath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create btrfs subvolume: %v, output: %s", err, string(output))
+	if params.RequireQuotas {
+		// Do not leave an unbounded volume behind
+		if err := d.deleteBtrfsSubvolume(subvolumePath); err != nil {
+			klog.Warningf("Failed to delete subvolume %s without quota: %v", subvolumePath, err)
+		}
+		return fmt.Errorf("failed to set quota for subvolume %s: %v", subvolumePath, err)
 	}
 
-	klog.Infof("Created btrfs subvolume: %s", subvolumePath)
+	// If quota setting fails, log warning but don't fail the subvolume creation
+	klog.Warningf("Failed to set quota for subvolume %s: %v", subvolumePath, err)
+	klog.Warningf("Subvolume created without quota - this may lead to unlimited growth")
+	return nil
+}
 
-	// Set quota if size is specified
-	if sizeBytes > 0 {
-		if err := d.setSubvolumeQuota(subvolumePath, sizeBytes); err != nil {
-			// If quota setting fails, log warning but don't fail the subvolume creation
-			klog.Warningf("Failed to set quota for subvolume %s: %v", subvolumePath, err)
-			klog.Warningf("Subvolume created without quota - this may lead to unlimited growth")
+// setSubvolumeAttributes sets the file attributes requested by the parameters on the root directory of a new subvolume,
+// from which all files created in the volume inherit them
+func (d *BtrfsDriver) setSubvolumeAttributes(subvolumePath string, params volumeParameters) error {
+	if params.NoDataCOW {
+		start := time.Now()
+		err := btrfs.SetNoCOW(hostPath(subvolumePath))
+		observeOperation("attribute set", start, err)
+		if err != nil {
+			return fmt.Errorf("failed to disable copy-on-write for subvolume %s: %v", subvolumePath, err)
 		}
+		klog.Infof("Disabled copy-on-write and checksums for subvolume %s", subvolumePath)
 	}
+	if params.Compression != "" {
+		if err := setSubvolumeCompression(subvolumePath, params.Compression); err != nil {
+			return err
+		}
+		klog.Infof("Set compression of subvolume %s to %s", subvolumePath, params.Compression)
+	}
+	return nil
+}
 
+// setSubvolumeCompression sets the compression property of the root directory of a subvolume,
+// which files created in the subvolume afterwards inherit
+func setSubvolumeCompression(subvolumePath, compression string) error {
+	start := time.Now()
+	err := btrfs.SetCompression(hostPath(subvolumePath), compression)
+	observeOperation("property set", start, err)
+	if err != nil {
+		return fmt.Errorf("failed to set compression of subvolume %s: %v", subvolumePath, err)
+	}
 	return nil
 }
 
+// getCompressionStats returns the amount of data of the given subvolume before and after compression.
+// Computing them requires reading all file extents, so they are cached like the results of walking the files.
+func (d *BtrfsDriver) getCompressionStats(subvolumePath string) (btrfs.CompressionStats, error) {
+	compute := func() (btrfs.CompressionStats, error) {
+		start := time.Now()
+		stats, err := btrfs.GetCompressionStats(hostPath(subvolumePath))
+		observeOperation("compression stats", start, err)
+		return stats, err
+	}
+
+	info, err := d.getSubvolumeInfo(subvolumePath)
+	if err != nil {
+		return compute()
+	}
+	return d.compressionStats.get(subvolumePath, info.LastChange, compute)
+}
+
+// deleteIncompleteSubvolume deletes a subvolume that could not be set up completely
+func (d *BtrfsDriver) deleteIncompleteSubvolume(subvolumePath string) {
+	if err := d.deleteBtrfsSubvolume(subvolumePath); err != nil {
+		klog.Warningf("Failed to delete incomplete subvolume %s: %v", subvolumePath, err)
+	}
+}
+
 // deleteBtrfsSubvolume deletes a Btrfs subvolume
 func (d *BtrfsDriver) deleteBtrfsSubvolume(subvolumePath string) error {
 	// Check if subvolume exists
-	if _, err := os.Stat(filepath.Join("/host", subvolumePath)); os.IsNotExist(err) {
+	if _, err := os.Stat(hostPath(subvolumePath)); os.IsNotExist(err) {
 		klog.Infof("Subvolume %s does not exist, skipping deletion", subvolumePath)
 		return nil
 	}
 
 	// Delete the subvolume
-	cmd := execWithLog("chroot", "/host", "btrfs", "subvolume", "delete", subvolumePath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to delete btrfs subvolume: %v, output: %s", err, string(output))
+	start := time.Now()
+	err := btrfs.DeleteSubvolume(hostPath(subvolumePath))
+	observeOperation("subvolume delete", start, err)
+	if err != nil {
+		return fmt.Errorf("failed to delete btrfs subvolume: %v", err)
 	}
+	d.diskUsages.forget(subvolumePath)
+	d.inodeCounts.forget(subvolumePath)
+	d.compressionStats.forget(subvolumePath)
 
 	klog.Infof("Deleted btrfs subvolume: %s", subvolumePath)
 	return nil
 }
 
-// setSubvolumeQuota sets a quota for a Btrfs subvolume
-func (d *BtrfsDriver) setSubvolumeQuota(subvolumePath string, sizeBytes int64) error {
+// createBtrfsSnapshot creates a snapshot of an existing Btrfs subvolume
+func (d *BtrfsDriver) createBtrfsSnapshot(sourcePath, snapshotPath string, readOnly bool) error {
+	start := time.Now()
+	err := btrfs.CreateSnapshot(hostPath(sourcePath), hostPath(snapshotPath), readOnly)
+	observeOperation("subvolume snapshot", start, err)
+	if err != nil {
+		return fmt.Errorf("failed to create btrfs snapshot: %v", err)
+	}
+
+	klog.Infof("Created btrfs snapshot %s of subvolume %s (read-only: %t)", snapshotPath, sourcePath, readOnly)
+	return nil
+}
+
+// isBtrfsSubvolume checks if the given path is the root of a Btrfs subvolume
+func isBtrfsSubvolume(path string) bool {
+	isSubvolume, err := btrfs.IsSubvolume(hostPath(path))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Warningf("Failed to check if %s is a btrfs subvolume: %v", path, err)
+		}
+		return false
+	}
+	return isSubvolume
+}
+
+// getSubvolumeInfo returns information about the given subvolume
+func (d *BtrfsDriver) getSubvolumeInfo(path string) (SubvolumeInfo, error) {
+	info, err := btrfs.GetSubvolumeInfo(hostPath(path))
+	if err != nil {
+		return SubvolumeInfo{Path: path}, err
+	}
+	klog.V(6).Infof("Btrfs subvolume info of %s: %#v", path, info)
+
+	return SubvolumeInfo{SubvolumeInfo: info, Path: path}, nil
+}
+
+// listSubvolumes returns information about all subvolumes directly below the given root path,
+// sorted by path
+func (d *BtrfsDriver) listSubvolumes(root string) ([]SubvolumeInfo, error) {
+	entries, err := os.ReadDir(hostPath(root))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read subvolume root %s: %v", root, err)
+	}
+
+	subvolumes := []SubvolumeInfo{}
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		if !entry.IsDir() || !isBtrfsSubvolume(path) {
+			continue
+		}
+		info, err := d.getSubvolumeInfo(path)
+		if err != nil {
+			return nil, err
+		}
+		subvolumes = append(subvolumes, info)
+	}
+
+	sort.Slice(subvolumes, func(i, j int) bool {
+		return subvolumes[i].Path < subvolumes[j].Path
+	})
+	return subvolumes, nil
+}
+
+// getFilesystemUUID returns the UUID of the Btrfs filesystem the given path is located on
+func (d *BtrfsDriver) getFilesystemUUID(path string) (string, error) {
+	info, err := btrfs.GetFilesystemInfo(hostPath(path))
+	if err != nil {
+		return "", err
+	}
+	return info.UUID, nil
+}
+
+// getSectorSize returns the sector size of the Btrfs filesystem the given path is located on,
+// which is the granularity in which data is allocated and accounted in qgroups
+func (d *BtrfsDriver) getSectorSize(path string) int64 {
+	info, err := btrfs.GetFilesystemInfo(hostPath(path))
+	if err != nil || info.SectorSize == 0 {
+		klog.V(4).Infof("Unable to determine sector size of %s, assuming %d bytes: %v", path, defaultSectorSize, err)
+		return defaultSectorSize
+	}
+	return int64(info.SectorSize)
+}
+
+// getDeviceStats returns the error counters of the devices of the Btrfs filesystem the given path is located on
+func (d *BtrfsDriver) getDeviceStats(path string) ([]btrfs.DeviceStats, error) {
+	return btrfs.GetDeviceStats(hostPath(path))
+}
+
+// getSubvolumeQgroup returns the accounting information of the qgroup of the given subvolume
+func (d *BtrfsDriver) getSubvolumeQgroup(path string) (btrfs.QgroupInfo, error) {
+	start := time.Now()
+	qgroup, err := btrfs.GetQgroupInfo(hostPath(path))
+	observeOperation("qgroup show", start, err)
+	return qgroup, err
+}
+
+// setSubvolumeQuota sets a quota for a Btrfs subvolume, limiting the bytes selected by the quota mode
+func (d *BtrfsDriver) setSubvolumeQuota(subvolumePath string, sizeBytes int64, mode QuotaMode) error {
+	if mode == QuotaModeNone {
+		return nil
+	}
+
 	// First, check if quotas are enabled
 	if !d.areQuotasEnabled(subvolumePath) {
 		return fmt.Errorf("quotas not enabled")
 	}
 
-	// Convert bytes to a more readable format for btrfs
-	quotaSize := formatQuotaSize(sizeBytes)
-
-	cmd := execWithLog("chroot", "/host", "btrfs", "qgroup", "limit", quotaSize, subvolumePath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to set quota: %v, output: %s", err, string(output))
+	var err error
+	start := time.Now()
+	if mode == QuotaModeExclusive {
+		err = btrfs.SetQgroupExclusiveLimit(hostPath(subvolumePath), sizeBytes)
+	} else {
+		err = btrfs.SetQgroupLimit(hostPath(subvolumePath), sizeBytes)
+	}
+	observeOperation("qgroup limit", start, err)
+	if err != nil {
+		return fmt.Errorf("failed to set quota: %v", err)
 	}
 
-	klog.Infof("Set quota %s for subvolume: %s", quotaSize, subvolumePath)
+	klog.Infof("Set %s quota %d bytes for subvolume: %s", mode, sizeBytes, subvolumePath)
 	return nil
 }
 
-// areQuotasEnabled checks if quotas are enabled without trying to enable them
-func (d *BtrfsDriver) areQuotasEnabled(path string) bool {
-	cmd := execWithLog("chroot", "/host", "btrfs", "qgroup", "show", filepath.Dir(path))
-	if err := cmd.Run(); err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
-			// Exit code 1 means quotas are not enabled
-			return false
-		}
-		// Other errors - assume quotas are not enabled
-		return false
+// getVolumeQuotaMode returns the quota mode the volume was created with
+func (d *BtrfsDriver) getVolumeQuotaMode(subvolumePath string) QuotaMode {
+	metadata, err := d.readVolumeMetadata(subvolumePath)
+	if err != nil {
+		klog.Warningf("Unable to read metadata of volume %s: %v", subvolumePath, err)
+	}
+	return metadata.GetQuotaMode()
+}
+
+// qgroupUsage returns the usage and limit (0 if unlimited) of a qgroup for the given quota mode.
+// Volumes without quota mode report their referenced bytes.
+func qgroupUsage(qgroup btrfs.QgroupInfo, mode QuotaMode) (int64, int64) {
+	switch mode {
+	case QuotaModeExclusive:
+		return qgroup.Exclusive, qgroup.MaxExclusive
+	case QuotaModeNone:
+		return qgroup.Referenced, 0
+	default:
+		return qgroup.Referenced, qgroup.MaxReferenced
 	}
-	// No error means quotas are enabled
-	return true
 }
 
-// formatQuotaSize formats the quota size for btrfs command
-func formatQuotaSize(sizeBytes int64) string {
-	// Convert to human readable format
-	if sizeBytes >= 1024*1024*1024 {
-		return fmt.Sprintf("%dG", sizeBytes/(1024*1024*1024))
-	} else if sizeBytes >= 1024*1024 {
-		return fmt.Sprintf("%dM", sizeBytes/(1024*1024))
-	} else if sizeBytes >= 1024 {
-		return fmt.Sprintf("%dK", sizeBytes/1024)
+// getAppliedCapacity returns the quota limit that is actually applied to the given subvolume.
+// If the limit cannot be read back (e.g. because quotas are disabled), the given capacity is returned.
+func (d *BtrfsDriver) getAppliedCapacity(subvolumePath string, mode QuotaMode, capacity int64) int64 {
+	if mode == QuotaModeNone {
+		return capacity
 	}
-	return fmt.Sprintf("%dB", sizeBytes)
+	qgroup, err := d.getSubvolumeQgroup(subvolumePath)
+	if err != nil {
+		klog.V(4).Infof("Unable to read back quota of subvolume %s: %v", subvolumePath, err)
+		return capacity
+	}
+	if _, limit := qgroupUsage(qgroup, mode); limit > 0 {
+		return limit
+	}
+	return capacity
 }
 
-// mountSubvolume mounts a Btrfs subvolume to the target path on the host
-func (d *BtrfsDriver) mountSubvolume(subvolumePath, targetPath string) error {
-	// Use bind mount to mount the subvolume
-	// TODO: implement native mount syscall
-	cmd := execWithLog("chroot", "/host", "mount", "--bind", subvolumePath, targetPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to bind mount subvolume: %v, output: %s", err, string(output))
+// ensureQuotas enables quotas on the filesystem of the subvolume root if requested by the parameters.
+// If quotas are required, it fails if they are not enabled.
+func (d *BtrfsDriver) ensureQuotas(subvolumeRoot string, params volumeParameters) error {
+	if params.EnableQuotas == QuotaAccountingNone && !params.RequireQuotas {
+		return nil
+	}
+
+	quotaStatus, err := btrfs.GetQuotaStatus(hostPath(subvolumeRoot))
+	if err != nil {
+		return fmt.Errorf("failed to get quota status of %s: %v", subvolumeRoot, err)
 	}
 
-	klog.Infof("Mounted subvolume %s to %s", subvolumePath, targetPath)
+	if !quotaStatus.Enabled && params.EnableQuotas != QuotaAccountingNone {
+		accounting := params.EnableQuotas
+		if accounting == QuotaAccountingSimple && !btrfs.SupportsSimpleQuota() {
+			klog.Warningf("Kernel does not support simple quotas, enabling full qgroup accounting on subvolume root %s instead", subvolumeRoot)
+			accounting = QuotaAccountingQgroup
+		}
+		start := time.Now()
+		err := btrfs.EnableQuota(hostPath(subvolumeRoot), accounting == QuotaAccountingSimple)
+		observeOperation("quota enable", start, err)
+		if err != nil {
+			return fmt.Errorf("failed to enable %s quotas: %v", accounting, err)
+		}
+		klog.Infof("Enabled %s quotas on the filesystem of subvolume root %s", accounting, subvolumeRoot)
+		return nil
+	}
+
+	if !quotaStatus.Enabled && params.RequireQuotas && params.QuotaMode != QuotaModeNone {
+		return fmt.Errorf("quotas are not enabled on the filesystem of subvolume root %s", subvolumeRoot)
+	}
 	return nil
 }
 
-// unmountVolume unmounts a volume from the target path on the host
-func (d *BtrfsDriver) unmountVolume(targetPath string) error {
-	// TODO: implement native mount syscall
-	cmd := exec.Command("chroot", "/host", "umount", targetPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to unmount volume: %v, output: %s", err, string(output))
+// getQuotaAccounting returns the quota accounting in use on the filesystem the given path is located on
+func (d *BtrfsDriver) getQuotaAccounting(path string) (QuotaAccounting, error) {
+	quotaStatus, err := btrfs.GetQuotaStatus(hostPath(path))
+	if err != nil {
+		return "", err
 	}
+	return quotaAccounting(quotaStatus), nil
+}
 
-	klog.Infof("Unmounted volume from %s", targetPath)
-	return nil
+// quotaAccounting returns the quota accounting of the given quota status
+func quotaAccounting(quotaStatus btrfs.QuotaStatus) QuotaAccounting {
+	switch {
+	case !quotaStatus.Enabled:
+		return QuotaAccountingNone
+	case quotaStatus.Simple:
+		return QuotaAccountingSimple
+	default:
+		return QuotaAccountingQgroup
+	}
 }
 
-// checkBtrfsSupport checks if Btrfs is supported on the system
-func (d *BtrfsDriver) checkBtrfsSupport() error {
-	// Check if btrfs command is available
-	cmd := exec.Command("chroot", "/host", "btrfs", "version")
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("btrfs command not found: %v", err)
+// isQgroupUsageAccurate checks whether the qgroup of the given subvolume accounts for all of its data.
+// Full qgroup accounting is inaccurate while it is inconsistent or being rescanned, e.g. right after
+// quotas were enabled. Simple quotas never account for extents written before they were enabled,
+// so they are inaccurate for subvolumes that already existed at that time.
+func (d *BtrfsDriver) isQgroupUsageAccurate(subvolumePath string) bool {
+	quotaStatus, err := btrfs.GetQuotaStatus(hostPath(subvolumePath))
+	if err != nil {
+		klog.Warningf("Failed to get quota status of %s: %v", subvolumePath, err)
+		return true
+	}
+	if !quotaStatus.Simple {
+		return !quotaStatus.Inconsistent && !quotaStatus.Rescanning
 	}
 
-	// Check if the root path is on a Btrfs filesystem
-	cmd = exec.Command("chroot", "/host", "btrfs", "filesystem", "show", DefaultBtrfsPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("path %s is not on a Btrfs filesystem: %v, output: %s", DefaultBtrfsPath, err, string(output))
+	subvolume, err := d.getSubvolumeInfo(subvolumePath)
+	if err != nil {
+		klog.Warningf("Failed to get subvolume info of %s: %v", subvolumePath, err)
+		return true
 	}
+	return subvolume.Generation >= quotaStatus.EnableGeneration
+}
 
-	klog.Infof("Btrfs support verified for path: %s", DefaultBtrfsPath)
-	return nil
+// areQuotasEnabled checks if quotas are enabled without trying to enable them
+func (d *BtrfsDriver) areQuotasEnabled(path string) bool {
+	quotaStatus, err := btrfs.GetQuotaStatus(hostPath(filepath.Dir(path)))
+	if err != nil {
+		// Errors - assume quotas are not enabled
+		klog.Warningf("Failed to get quota status of %s: %v", path, err)
+		return false
+	}
+	return quotaStatus.Enabled
 }
 
 // SubvolumeInfo contains information about a Btrfs subvolume
 type SubvolumeInfo struct {
-	ID   int
+	btrfs.SubvolumeInfo
 	Path string
 }
 
+// BtrfsFilesystemUsage contains the allocation of a Btrfs filesystem
 type BtrfsFilesystemUsage struct {
-	DeviceSize        int64   // Device size in bytes
-	DeviceAllocated   int64   // Device allocated in bytes
-	DeviceUnallocated int64   // Device unallocated in bytes
-	DeviceMissing     int64   // Device missing in bytes
-	DeviceSlack       int64   // Device slack in bytes
-	Used              int64   // Used bytes
-	FreeEstimated     int64   // Free (estimated) bytes
-	FreeEstimatedMin  int64   // Free (estimated) min bytes
-	FreeStatfs        int64   // Free (statfs, df) bytes
-	DataRatio         float64 // Data ratio
-	MetadataRatio     float64 // Metadata ratio
-	GlobalReserve     int64   // Global reserve bytes
-	GlobalReserveUsed int64   // Global reserve used bytes
-	MultipleProfiles  bool    // Multiple profiles (true if "yes", false if "no")
-}
-
-// getBtrfsFilesystemUsage parses the output of 'btrfs filesystem usage' for volume usage statistics
+	btrfs.FilesystemUsage
+}
+
+// getBtrfsFilesystemUsage returns the allocation of the Btrfs filesystem the given path is located on
 func (d *BtrfsDriver) getBtrfsFilesystemUsage(path string) (BtrfsFilesystemUsage, error) {
-	usage := BtrfsFilesystemUsage{}
+	start := time.Now()
+	usage, err := btrfs.GetFilesystemUsage(hostPath(path))
+	observeOperation("filesystem usage", start, err)
+	if err != nil {
+		return BtrfsFilesystemUsage{}, fmt.Errorf("failed to get btrfs filesystem usage: %v", err)
+	}
+	klog.V(6).Infof("Btrfs filesystem usage of %s: %#v", path, usage)
+	return BtrfsFilesystemUsage{usage}, nil
+}
+
+// VolumeUsage contains the usage statistics of a single volume
+type VolumeUsage struct {
+	TotalBytes      int64
+	UsedBytes       int64
+	AvailableBytes  int64
+	TotalInodes     int64 // 0 if the filesystem has no fixed number of inodes
+	UsedInodes      int64
+	AvailableInodes int64
+}
+
+// getVolumeUsage returns the usage statistics of the given subvolume mounted at the volume path.
+// Byte usage is taken from the subvolume's qgroup according to the quota mode of the volume, only if quotas are disabled the usage of the
+// entire filesystem is reported. With simple quotas, the qgroup only contains the data written
+// to the subvolume itself, data shared with the snapshot or volume it was created from is charged
+// to the source.
+func (d *BtrfsDriver) getVolumeUsage(subvolumePath, volumePath string) (VolumeUsage, error) {
+	usage := VolumeUsage{}
+
+	qgroup, err := d.getSubvolumeQgroup(subvolumePath)
+	used, limit := qgroupUsage(qgroup, d.getVolumeQuotaMode(subvolumePath))
+	if err == nil && !d.isQgroupUsageAccurate(subvolumePath) {
+		// The files are counted in full, even if the volume is limited to its exclusive bytes
+		klog.V(4).Infof("Qgroup of subvolume %s does not account for all data, counting the usage of its files", subvolumePath)
+		if used, err = d.walkVolume(d.diskUsages, subvolumePath, volumePath, diskUsage); err != nil {
+			return usage, fmt.Errorf("failed to count disk usage of %s: %v", volumePath, err)
+		}
+	}
+
+	switch {
+	case err == nil && limit > 0:
+		usage.TotalBytes = limit
+		usage.UsedBytes = used
+		usage.AvailableBytes = max(limit-used, 0)
+	case err == nil:
+		// Without a limit, the subvolume can grow until the filesystem is full
+		filesystemUsage, err := d.getBtrfsFilesystemUsage(volumePath)
+		if err != nil {
+			return usage, err
+		}
+		usage.UsedBytes = used
+		usage.AvailableBytes = filesystemUsage.FreeEstimated
+		usage.TotalBytes = usage.UsedBytes + usage.AvailableBytes
+	case errors.Is(err, btrfs.ErrQuotaDisabled):
+		klog.V(4).Infof("Quotas are disabled for subvolume %s, reporting filesystem usage", subvolumePath)
+		filesystemUsage, err := d.getBtrfsFilesystemUsage(volumePath)
+		if err != nil {
+			return usage, err
+		}
+		usage.TotalBytes = filesystemUsage.DeviceSize
+		usage.UsedBytes = filesystemUsage.Used
+		usage.AvailableBytes = filesystemUsage.FreeEstimated
+	default:
+		return usage, fmt.Errorf("failed to get qgroup of subvolume %s: %v", subvolumePath, err)
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(hostPath(volumePath), &statfs); err != nil {
+		return usage, fmt.Errorf("failed to stat filesystem of %s: %v", volumePath, err)
+	}
+	if statfs.Files > 0 {
+		usage.TotalInodes = int64(statfs.Files)
+		usage.AvailableInodes = int64(statfs.Ffree)
+		usage.UsedInodes = usage.TotalInodes - usage.AvailableInodes
+	} else {
+		// Btrfs allocates inodes dynamically and does not report inode numbers via statfs,
+		// therefore count the inodes in use by the volume
+		usage.UsedInodes, err = d.walkVolume(d.inodeCounts, subvolumePath, volumePath, countInodes)
+		if err != nil {
+			return usage, fmt.Errorf("failed to count inodes of %s: %v", volumePath, err)
+		}
+	}
+
+	klog.V(6).Infof("Volume usage of %s: %#v", subvolumePath, usage)
+	return usage, nil
+}
 
-	// Use btrfs filesystem usage to get accurate usage statistics
-	cmd := exec.Command("chroot", "/host", "btrfs", "filesystem", "usage", "--raw", path)
-	output, err := cmd.CombinedOutput()
+// walkVolume returns the result of walking the files of a volume with the given function.
+// Walking a volume with many files is slow and kubelet requests the stats of every volume each minute,
+// therefore the result is cached until the volume changes, but at most for the TTL of the cache.
+func (d *BtrfsDriver) walkVolume(cache *usageCache[int64], subvolumePath, volumePath string, walk func(string) (int64, error)) (int64, error) {
+	info, err := d.getSubvolumeInfo(subvolumePath)
 	if err != nil {
-		return usage, fmt.Errorf("failed to get btrfs filesystem usage: %v, output: %s", err, string(output))
-	}
-
-	// Example output:
-	// Overall:
-	//     Device size:                       10737418240
-	//     Device allocated:                    562036736
-	//     Device unallocated:                10175381504
-	//     Device missing:                              0
-	//     Device slack:                                0
-	//     Used:                                   393216
-	//     Free (estimated):                  10183770112      (min: 5096079360)
-	//     Free (statfs, df):                 10182721536
-	//     Data ratio:                               1.00
-	//     Metadata ratio:                           2.00
-	//     Global reserve:                        5767168      (used: 0)
-	//     Multiple profiles:                          no
-
-	// Parse the output to get the usage statistics
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		fields := strings.Split(line, ":")
-		if len(fields) >= 2 {
-			key := strings.TrimSpace(fields[0])
-			value := strings.TrimSpace(fields[1])
-			if value != "" {
-				// required for lines that have trailing output, e.g.
-				// `10183770112      (min: 5096079360)`
-				value = strings.Fields(fields[1])[0]
+		return walk(hostPath(volumePath))
+	}
+	return cache.get(subvolumePath, info.LastChange, func() (int64, error) {
+		return walk(hostPath(volumePath))
+	})
+}
+
+// diskUsage returns the bytes allocated by the files and directories below the given path,
+// counting files with multiple hard links only once
+func diskUsage(path string) (int64, error) {
+	var usage int64
+	seen := map[uint64]bool{}
+	err := filepath.WalkDir(path, func(p string, _ fs.DirEntry, err error) error {
+		var stat unix.Stat_t
+		if err == nil {
+			err = unix.Lstat(p, &stat)
+		}
+		if err != nil {
+			// Files may be removed while walking the directory
+			if os.IsNotExist(err) {
+				return nil
 			}
-			switch key {
-			case "Device size":
-				usage.DeviceSize, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse device size: %v", err)
-				}
-			case "Device allocated":
-				usage.DeviceAllocated, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse device allocated: %v", err)
-				}
-			case "Device unallocated":
-				usage.DeviceUnallocated, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse device unallocated: %v", err)
-				}
-			case "Device missing":
-				usage.DeviceMissing, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse device missing: %v", err)
-				}
-			case "Device slack":
-				usage.DeviceSlack, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse device slack: %v", err)
-				}
-			case "Used":
-				usage.Used, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse used: %v", err)
-				}
-			case "Free (estimated)":
-				usage.FreeEstimated, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse free estimated: %v", err)
-				}
-			case "Free (statfs, df)":
-				usage.FreeStatfs, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse free statfs: %v", err)
-				}
-			case "Data ratio":
-				usage.DataRatio, err = strconv.ParseFloat(value, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse data ratio: %v", err)
-				}
-			case "Metadata ratio":
-				usage.MetadataRatio, err = strconv.ParseFloat(value, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse metadata ratio: %v", err)
-				}
-			case "Global reserve":
-				usage.GlobalReserve, err = strconv.ParseInt(value, 10, 64)
-				if err != nil {
-					return usage, fmt.Errorf("failed to parse global reserve: %v", err)
-				}
+			return err
+		}
+
+		if stat.Nlink > 1 && stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			if seen[stat.Ino] {
+				return nil
 			}
+			seen[stat.Ino] = true
 		}
-	}
-	klog.V(6).Infof("Btrfs filesystem usage of %s: %#v", path, usage)
+		usage += stat.Blocks * 512
+		return nil
+	})
+	return usage, err
+}
 
-	return usage, nil
+// countInodes counts the files and directories below the given path (including the path itself)
+func countInodes(path string) (int64, error) {
+	var count int64
+	err := filepath.WalkDir(path, func(_ string, _ fs.DirEntry, err error) error {
+		if err != nil {
+			// Files may be removed while walking the directory
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		count++
+		return nil
+	})
+	return count, err
 }
 
 // Initialize BtrfsManager in the driver
 func (d *BtrfsDriver) initBtrfsManager() error {
 	d.btrfsManager = NewBtrfsManager()
-	// return d.checkBtrfsSupport()
+
+	// Do not fail the startup, the subvolume roots may be mounted later on.
+	// Until then Probe reports the driver as not ready.
+	if err := d.checkReadiness(); err != nil {
+		klog.Warningf("Driver is not ready: %v", err)
+	} else {
+		klog.Infof("Btrfs support verified for subvolume roots: %v", d.getSubvolumeRoots())
+	}
+
+	for _, root := range d.getSubvolumeRoots() {
+		if accounting, err := d.getQuotaAccounting(root); err == nil {
+			klog.Infof("Subvolume root %s uses quota accounting %s", root, accounting)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,82 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btrfs-csi/driver/internal/btrfs"
+)
+
+func TestDiskUsage(t *testing.T) {
+	dir := t.TempDir()
+
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = 1
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file"), data, 0644); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := os.Link(filepath.Join(dir, "file"), filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("Failed to create hard link: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "subdir"), 0755); err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+
+	usage, err := diskUsage(dir)
+	if err != nil {
+		t.Fatalf("diskUsage failed: %v", err)
+	}
+	// The hard link must not be counted twice
+	if usage < int64(len(data)) || usage >= 2*int64(len(data)) {
+		t.Errorf("Expected disk usage between %d and %d bytes, got %d", len(data), 2*len(data), usage)
+	}
+
+	if _, err := diskUsage(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("Expected no error for a missing path, got %v", err)
+	}
+}
+
+func TestQuotaAccounting(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   btrfs.QuotaStatus
+		expected QuotaAccounting
+	}{
+		{name: "disabled", status: btrfs.QuotaStatus{}, expected: QuotaAccountingNone},
+		{name: "disabled with stale flags", status: btrfs.QuotaStatus{Simple: true}, expected: QuotaAccountingNone},
+		{name: "qgroup", status: btrfs.QuotaStatus{Enabled: true}, expected: QuotaAccountingQgroup},
+		{name: "inconsistent qgroup", status: btrfs.QuotaStatus{Enabled: true, Inconsistent: true}, expected: QuotaAccountingQgroup},
+		{name: "simple", status: btrfs.QuotaStatus{Enabled: true, Simple: true, EnableGeneration: 42}, expected: QuotaAccountingSimple},
+	}
+
+	for _, tt := range tests {
+		if accounting := quotaAccounting(tt.status); accounting != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, accounting)
+		}
+	}
+}
+
+func TestQgroupUsage(t *testing.T) {
+	qgroup := btrfs.QgroupInfo{Referenced: 3000, Exclusive: 1000, MaxReferenced: 8192, MaxExclusive: 4096}
+
+	tests := []struct {
+		mode  QuotaMode
+		used  int64
+		limit int64
+	}{
+		{mode: QuotaModeReferenced, used: 3000, limit: 8192},
+		{mode: QuotaModeExclusive, used: 1000, limit: 4096},
+		{mode: QuotaModeNone, used: 3000, limit: 0},
+		{mode: "", used: 3000, limit: 8192},
+	}
+
+	for _, tt := range tests {
+		used, limit := qgroupUsage(qgroup, tt.mode)
+		if used != tt.used || limit != tt.limit {
+			t.Errorf("Quota mode %q: expected %d of %d bytes, got %d of %d", tt.mode, tt.used, tt.limit, used, limit)
+		}
+	}
+}
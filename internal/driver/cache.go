@@ -0,0 +1,60 @@
+package driver
+
+import (
+	"sync"
+	"time"
+)
+
+// usageCacheTTL is how long usage statistics that require walking a volume are reused while the volume keeps changing
+const usageCacheTTL = 10 * time.Minute
+
+// usageCache caches statistics of subvolumes that are expensive to compute, e.g. because all files have to be walked.
+// A cached value is reused as long as the subvolume did not change, or until it is older than the TTL.
+type usageCache[T any] struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]usageCacheEntry[T]
+}
+
+type usageCacheEntry[T any] struct {
+	value      T
+	lastChange uint64 // last transaction that changed the subvolume when the value was computed
+	computed   time.Time
+}
+
+// newUsageCache creates an empty cache whose entries expire after the given TTL
+func newUsageCache[T any](ttl time.Duration) *usageCache[T] {
+	return &usageCache[T]{
+		ttl:     ttl,
+		entries: map[string]usageCacheEntry[T]{},
+	}
+}
+
+// get returns the cached value of the subvolume, or computes and caches it if the subvolume changed
+// since the value was computed and the value has expired
+func (c *usageCache[T]) get(subvolumePath string, lastChange uint64, compute func() (T, error)) (T, error) {
+	c.mutex.Lock()
+	entry, ok := c.entries[subvolumePath]
+	c.mutex.Unlock()
+	if ok && (entry.lastChange == lastChange || time.Since(entry.computed) < c.ttl) {
+		return entry.value, nil
+	}
+
+	// The lock is not held while computing, so that slow volumes do not block the others
+	value, err := compute()
+	if err != nil {
+		return value, err
+	}
+
+	c.mutex.Lock()
+	c.entries[subvolumePath] = usageCacheEntry[T]{value: value, lastChange: lastChange, computed: time.Now()}
+	c.mutex.Unlock()
+	return value, nil
+}
+
+// forget removes the cached value of a subvolume, e.g. after it was deleted
+func (c *usageCache[T]) forget(subvolumePath string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.entries, subvolumePath)
+}
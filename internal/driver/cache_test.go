@@ -0,0 +1,56 @@
+package driver
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUsageCache(t *testing.T) {
+	computed := 0
+	compute := func() (int64, error) {
+		computed++
+		return int64(computed), nil
+	}
+
+	// Without a TTL, values are only reused while the subvolume does not change
+	cache := newUsageCache[int64](0)
+	for i, tt := range []struct {
+		lastChange uint64
+		expected   int64
+	}{
+		{lastChange: 10, expected: 1},
+		{lastChange: 10, expected: 1},
+		{lastChange: 11, expected: 2},
+		{lastChange: 11, expected: 2},
+	} {
+		value, err := cache.get("/var/lib/btrfs-csi/vol", tt.lastChange, compute)
+		if err != nil || value != tt.expected {
+			t.Errorf("Call %d: expected %d, got %d (error: %v)", i, tt.expected, value, err)
+		}
+	}
+
+	// Changed subvolumes reuse values until they expire
+	cache = newUsageCache[int64](time.Hour)
+	if value, _ := cache.get("/var/lib/btrfs-csi/vol", 10, compute); value != 3 {
+		t.Errorf("Expected a new value 3, got %d", value)
+	}
+	if value, _ := cache.get("/var/lib/btrfs-csi/vol", 12, compute); value != 3 {
+		t.Errorf("Expected the cached value 3 before the TTL, got %d", value)
+	}
+
+	// Values of deleted subvolumes must not be reused by new subvolumes with the same path
+	cache.forget("/var/lib/btrfs-csi/vol")
+	if value, _ := cache.get("/var/lib/btrfs-csi/vol", 12, compute); value != 4 {
+		t.Errorf("Expected a new value 4 after forgetting the subvolume, got %d", value)
+	}
+
+	// Errors are not cached
+	failing := func() (int64, error) { return 0, errors.New("failed") }
+	if _, err := cache.get("/var/lib/btrfs-csi/other", 1, failing); err == nil {
+		t.Errorf("Expected an error")
+	}
+	if value, _ := cache.get("/var/lib/btrfs-csi/other", 1, compute); value != 5 {
+		t.Errorf("Expected a new value 5 after an error, got %d", value)
+	}
+}
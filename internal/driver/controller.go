@@ -2,13 +2,21 @@ package driver
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 	"k8s.io/klog/v2"
 )
 
@@ -20,11 +28,43 @@ func (d *BtrfsDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeReq
 		return nil, err
 	}
 
+	contentSource := req.GetVolumeContentSource()
+	unlock, err := d.lockNewVolume(req.GetName(), contentSource.GetSnapshot().GetSnapshotId(), contentSource.GetVolume().GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	// Get subvolume root from SC parameters and create full path for subvolume
 	subvolumeRoot := d.getSubvolumeRootFromVolumeContext(req.GetParameters())
+	if !d.isSubvolumeRoot(subvolumeRoot) {
+		return nil, status.Errorf(codes.InvalidArgument, "subvolume root %s is not one of the configured subvolume roots %v", subvolumeRoot, d.getSubvolumeRoots())
+	}
 	subvolumePath := filepath.Join(subvolumeRoot, req.GetName())
+	if err := d.validateSubvolumePath(subvolumePath); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume path: %v", err)
+	}
+	params, err := d.parseVolumeParameters(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	params.Block = isBlockVolumeRequest(req.GetVolumeCapabilities())
+	if params.Block {
+		// The size of a raw block volume is limited by its image file instead of a quota
+		params.QuotaMode = QuotaModeNone
+	}
 
-	capacity := req.GetCapacityRange().GetRequiredBytes()
+	// The quota is set in exact bytes, so the capacity only needs to be aligned to the sector size
+	capacity, err := getCapacity(req.GetCapacityRange(), d.getSectorSize(subvolumeRoot))
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "unsupported capacity range: %v", err)
+	}
+	if params.Block && capacity == 0 {
+		return nil, status.Error(codes.InvalidArgument, "raw block volumes require a capacity")
+	}
+	if params.Block && params.Compression != "" && params.Compression != "none" {
+		return nil, status.Errorf(codes.InvalidArgument, "raw block volumes cannot be compressed, their image is written without copy-on-write")
+	}
 
 	// Determine the target node for this volume
 	targetNode := d.nodeID // Default to controller node
@@ -48,15 +88,77 @@ func (d *BtrfsDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeReq
 		}
 	}
 
+	metadata := &VolumeMetadata{
+		Type:          metadataTypeVolume,
+		Name:          req.GetName(),
+		CapacityBytes: capacity,
+		Parameters:    req.GetParameters(),
+		TargetNode:    targetNode,
+		QuotaMode:     params.QuotaMode,
+		Block:         params.Block,
+		Preallocated:  params.Block && params.Preallocate,
+		NoDataCOW:     params.NoDataCOW,
+		NoDataSum:     params.NoDataSum,
+		Compression:   params.Compression,
+		CreationTime:  time.Now().UTC(),
+	}
+	if contentSource := req.GetVolumeContentSource(); contentSource != nil {
+		metadata.SourceSnapshotID = contentSource.GetSnapshot().GetSnapshotId()
+		metadata.SourceVolumeID = contentSource.GetVolume().GetVolumeId()
+	}
+
+	// A repeated request for an existing volume only succeeds if it is compatible with the original request.
+	// Names are unique across all subvolume roots, so a request for another root must not create a second volume.
+	if existingPath := d.findSubvolumeByName(req.GetName()); existingPath != "" {
+		if err := d.validateExistingVolume(existingPath, metadata, req.GetCapacityRange()); err != nil {
+			return nil, err
+		}
+		klog.Infof("CreateVolume: volume %s already exists", existingPath)
+
+		return &csi.CreateVolumeResponse{
+			Volume: d.newCreatedCSIVolume(metadata, req.GetVolumeContentSource()),
+		}, nil
+	}
+	if _, err := os.Lstat(hostPath(subvolumePath)); err == nil {
+		return nil, status.Errorf(codes.AlreadyExists, "path %s already exists and is not a subvolume", subvolumePath)
+	}
+
 	klog.Infof("CreateVolume: creating volume %s for node %s", subvolumePath, targetNode)
 
-	// Create the Btrfs subvolume
-	if err := d.createBtrfsSubvolume(subvolumePath, capacity); err != nil {
+	if err := d.ensureQuotas(subvolumeRoot, params); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "cannot enforce the capacity of volume %s: %v", subvolumePath, err)
+	}
+
+	// Create the Btrfs subvolume, either empty or from the requested content source
+	if contentSource := req.GetVolumeContentSource(); contentSource != nil {
+		if err := d.createVolumeFromContentSource(contentSource, subvolumePath, capacity, targetNode, params); err != nil {
+			return nil, err
+		}
+	} else if err := d.createBtrfsSubvolume(subvolumePath, capacity, params); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create btrfs subvolume: %v", err)
 	}
 
-	klog.Infof("CreateVolume: created subvolume %s with capacity %d bytes", subvolumePath, capacity)
+	subvolume, err := d.getSubvolumeInfo(subvolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get subvolume info of %s: %v", subvolumePath, err)
+	}
+	if metadata.ID, err = d.newVolumeID(subvolume); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to determine volume ID: %v", err)
+	}
+	metadata.CapacityBytes = d.getAppliedCapacity(subvolumePath, params.QuotaMode, capacity)
+	if err := d.writeVolumeMetadata(subvolumePath, metadata); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to write volume metadata: %v", err)
+	}
+
+	klog.Infof("CreateVolume: created subvolume %s with capacity %d bytes", subvolumePath, metadata.CapacityBytes)
+
+	return &csi.CreateVolumeResponse{
+		Volume: d.newCreatedCSIVolume(metadata, req.GetVolumeContentSource()),
+	}, nil
+}
 
+// newCreatedCSIVolume returns the CSI volume for the response of a CreateVolume request
+func (d *BtrfsDriver) newCreatedCSIVolume(metadata *VolumeMetadata, contentSource *csi.VolumeContentSource) *csi.Volume {
 	volume := &csi.Volume{
 		// The identifier for this volume, generated by the plugin.
 		// This field is REQUIRED.
@@ -64,28 +166,236 @@ func (d *BtrfsDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeReq
 		// this specific volume vs all other volumes supported by this plugin.
 		// This field SHALL be used by the CO in subsequent calls to refer to
 		// this volume.
-		VolumeId:      subvolumePath,
-		CapacityBytes: capacity,
-		VolumeContext: map[string]string{
-			"storage.kubernetes.io/csiProvisionerIdentity": "btrfs-csi",
-			"targetNode": targetNode,
-			"capacity":   strconv.FormatInt(capacity, 10),
-		},
-		ContentSource: req.GetVolumeContentSource(),
+		VolumeId:      metadata.ID,
+		CapacityBytes: metadata.CapacityBytes,
+		VolumeContext: d.getVolumeContext(metadata),
+		ContentSource: contentSource,
 	}
 
 	// Add accessibility requirements for local volumes
 	volume.AccessibleTopology = []*csi.Topology{
 		{
 			Segments: map[string]string{
-				"kubernetes.io/hostname": targetNode,
+				"kubernetes.io/hostname": metadata.TargetNode,
 			},
 		},
 	}
 
-	return &csi.CreateVolumeResponse{
-		Volume: volume,
-	}, nil
+	return volume
+}
+
+// findSubvolumeByName returns the path of the subvolume with the given name in any of the subvolume roots,
+// or an empty string if there is none
+func (d *BtrfsDriver) findSubvolumeByName(name string) string {
+	for _, root := range d.getSubvolumeRoots() {
+		if path := filepath.Join(root, name); isBtrfsSubvolume(path) {
+			return path
+		}
+	}
+	return ""
+}
+
+// validateExistingVolume checks that an existing volume was created with the same arguments as the requested volume
+// and that its capacity satisfies the requested capacity range
+func (d *BtrfsDriver) validateExistingVolume(subvolumePath string, requested *VolumeMetadata, capacityRange *csi.CapacityRange) error {
+	if root := d.getSubvolumeRootFromVolumeContext(requested.Parameters); filepath.Dir(subvolumePath) != root {
+		return status.Errorf(codes.AlreadyExists, "volume %s already exists in subvolume root %s instead of %s",
+			requested.Name, filepath.Dir(subvolumePath), root)
+	}
+	info, err := d.getSubvolumeInfo(subvolumePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get subvolume info of %s: %v", subvolumePath, err)
+	}
+	if info.ReadOnly {
+		return status.Errorf(codes.AlreadyExists, "subvolume %s already exists and is a snapshot", subvolumePath)
+	}
+
+	existing, err := d.readVolumeMetadata(subvolumePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read volume metadata: %v", err)
+	}
+
+	if existing != nil {
+		switch {
+		case existing.Type != metadataTypeVolume:
+			return status.Errorf(codes.AlreadyExists, "subvolume %s already exists and is not a volume", subvolumePath)
+		case existing.Block != requested.Block:
+			return status.Errorf(codes.AlreadyExists, "volume %s already exists with a different volume mode", subvolumePath)
+		case !capacityInRange(existing.CapacityBytes, capacityRange):
+			return status.Errorf(codes.AlreadyExists, "volume %s already exists with capacity %d bytes, requested %d to %d bytes",
+				subvolumePath, existing.CapacityBytes, capacityRange.GetRequiredBytes(), capacityRange.GetLimitBytes())
+		case existing.SourceSnapshotID != requested.SourceSnapshotID || existing.SourceVolumeID != requested.SourceVolumeID:
+			return status.Errorf(codes.AlreadyExists, "volume %s already exists with a different content source", subvolumePath)
+		case !maps.Equal(existing.Parameters, requested.Parameters):
+			return status.Errorf(codes.AlreadyExists, "volume %s already exists with different parameters", subvolumePath)
+		}
+		requested.ID = existing.ID
+		requested.CapacityBytes = existing.CapacityBytes
+		if requested.ID == "" {
+			// Volumes created before structured volume IDs are identified by their path
+			requested.ID = subvolumePath
+		}
+		requested.TargetNode = existing.TargetNode
+		requested.CreationTime = existing.CreationTime
+		return nil
+	}
+
+	// Without metadata (the driver was interrupted before writing it, or the volume predates it),
+	// compare against what can be observed on the subvolume itself
+	if qgroup, err := d.getSubvolumeQgroup(subvolumePath); err == nil && qgroup.MaxReferenced > 0 {
+		if !capacityInRange(qgroup.MaxReferenced, capacityRange) {
+			return status.Errorf(codes.AlreadyExists, "volume %s already exists with capacity %d bytes, requested %d to %d bytes",
+				subvolumePath, qgroup.MaxReferenced, capacityRange.GetRequiredBytes(), capacityRange.GetLimitBytes())
+		}
+		requested.CapacityBytes = qgroup.MaxReferenced
+	}
+
+	sourceID := requested.SourceSnapshotID
+	if sourceID == "" {
+		sourceID = requested.SourceVolumeID
+	}
+	var sourceUUID string
+	if sourceID != "" {
+		sourcePath, err := d.resolveVolumeID(sourceID)
+		if err == nil && isBtrfsSubvolume(sourcePath) {
+			sourceInfo, err := d.getSubvolumeInfo(sourcePath)
+			if err != nil {
+				return status.Errorf(codes.Internal, "failed to get volume content source info: %v", err)
+			}
+			sourceUUID = sourceInfo.UUID
+		}
+	}
+	if info.ParentUUID != sourceUUID {
+		return status.Errorf(codes.AlreadyExists, "volume %s already exists with a different content source", subvolumePath)
+	}
+
+	if requested.ID, err = d.newVolumeID(info); err != nil {
+		return status.Errorf(codes.Internal, "failed to determine volume ID: %v", err)
+	}
+	// The subvolume may have been created by an older version of the driver, whose volumes the CO knows by their path
+	requested.LegacyID = subvolumePath
+	if err := d.writeVolumeMetadata(subvolumePath, requested); err != nil {
+		return status.Errorf(codes.Internal, "failed to write volume metadata: %v", err)
+	}
+	return nil
+}
+
+// createVolumeFromContentSource creates the subvolume of a new volume from a snapshot or another volume
+func (d *BtrfsDriver) createVolumeFromContentSource(contentSource *csi.VolumeContentSource, subvolumePath string, capacity int64, targetNode string, params volumeParameters) error {
+	// Content sources are subvolumes on the local Btrfs filesystems, they are not accessible from other nodes
+	if targetNode != d.nodeID {
+		return status.Errorf(codes.InvalidArgument, "volume content source on node %s cannot be used for a volume on node %s", d.nodeID, targetNode)
+	}
+
+	switch {
+	case contentSource.GetSnapshot() != nil:
+		return d.createVolumeFromSnapshot(contentSource.GetSnapshot().GetSnapshotId(), subvolumePath, capacity, params)
+	case contentSource.GetVolume() != nil:
+		return d.createVolumeFromVolume(contentSource.GetVolume().GetVolumeId(), subvolumePath, capacity, params)
+	default:
+		return status.Errorf(codes.InvalidArgument, "unsupported volume content source: %v", contentSource)
+	}
+}
+
+// createVolumeFromSnapshot creates the subvolume of a new volume as a writable snapshot of an existing snapshot
+func (d *BtrfsDriver) createVolumeFromSnapshot(snapshotID, subvolumePath string, capacity int64, params volumeParameters) error {
+	snapshotPath, err := d.resolveVolumeID(snapshotID)
+	if errors.Is(err, errVolumeNotAllowed) {
+		return resolveVolumeIDError(snapshotID, err)
+	} else if err != nil || !isBtrfsSubvolume(snapshotPath) {
+		return status.Errorf(codes.NotFound, "snapshot %s does not exist on node %s", snapshotID, d.nodeID)
+	}
+	if err := d.validateDriverSubvolume(snapshotID, snapshotPath, metadataTypeSnapshot); err != nil {
+		return err
+	}
+
+	if err := d.validateSameFilesystem(snapshotPath, subvolumePath); err != nil {
+		return err
+	}
+	if d.isBlockVolume(snapshotPath) != params.Block {
+		return status.Errorf(codes.InvalidArgument, "volume mode of snapshot %s does not match the requested volume", snapshotID)
+	}
+
+	// The new volume must be able to hold all data of the snapshot
+	if params.Block {
+		if size, _, err := getBlockImageUsage(snapshotPath); err == nil && size > capacity {
+			return status.Errorf(codes.OutOfRange, "requested capacity %d bytes is smaller than snapshot size %d bytes", capacity, size)
+		}
+	} else if qgroup, err := d.getSubvolumeQgroup(snapshotPath); err == nil && capacity > 0 && qgroup.Referenced > capacity {
+		return status.Errorf(codes.OutOfRange, "requested capacity %d bytes is smaller than snapshot size %d bytes", capacity, qgroup.Referenced)
+	}
+
+	klog.Infof("CreateVolume: creating volume %s from snapshot %s", subvolumePath, snapshotPath)
+
+	if err := d.createBtrfsSubvolumeFromSource(snapshotPath, subvolumePath, capacity, params); err != nil {
+		return status.Errorf(codes.Internal, "failed to create btrfs subvolume from snapshot: %v", err)
+	}
+
+	return nil
+}
+
+// createVolumeFromVolume creates the subvolume of a new volume as a writable snapshot (clone) of an existing volume
+func (d *BtrfsDriver) createVolumeFromVolume(sourceVolumeID, subvolumePath string, capacity int64, params volumeParameters) error {
+	sourcePath, err := d.resolveVolumeID(sourceVolumeID)
+	if errors.Is(err, errVolumeNotAllowed) {
+		return resolveVolumeIDError(sourceVolumeID, err)
+	} else if err != nil || !isBtrfsSubvolume(sourcePath) {
+		return status.Errorf(codes.NotFound, "source volume %s does not exist on node %s", sourceVolumeID, d.nodeID)
+	}
+	if err := d.validateDriverSubvolume(sourceVolumeID, sourcePath, metadataTypeVolume); err != nil {
+		return err
+	}
+
+	if err := d.validateSameFilesystem(sourcePath, subvolumePath); err != nil {
+		return err
+	}
+	if d.isBlockVolume(sourcePath) != params.Block {
+		return status.Errorf(codes.InvalidArgument, "volume mode of source volume %s does not match the requested volume", sourceVolumeID)
+	}
+
+	// The clone must be at least as large as the source volume, i.e. its image size, its quota limit
+	// or (if it has no limit) the amount of data it currently references
+	if params.Block {
+		if size, _, err := getBlockImageUsage(sourcePath); err == nil && size > capacity {
+			return status.Errorf(codes.OutOfRange, "requested capacity %d bytes is smaller than source volume size %d bytes", capacity, size)
+		}
+	} else if qgroup, err := d.getSubvolumeQgroup(sourcePath); err == nil && capacity > 0 {
+		_, sourceCapacity := qgroupUsage(qgroup, d.getVolumeQuotaMode(sourcePath))
+		if sourceCapacity == 0 {
+			sourceCapacity = qgroup.Referenced
+		}
+		if sourceCapacity > capacity {
+			return status.Errorf(codes.OutOfRange, "requested capacity %d bytes is smaller than source volume size %d bytes", capacity, sourceCapacity)
+		}
+	}
+
+	klog.Infof("CreateVolume: cloning volume %s from volume %s", subvolumePath, sourcePath)
+
+	if err := d.createBtrfsSubvolumeFromSource(sourcePath, subvolumePath, capacity, params); err != nil {
+		return status.Errorf(codes.Internal, "failed to clone btrfs subvolume: %v", err)
+	}
+
+	return nil
+}
+
+// validateSameFilesystem checks that a new subvolume can be created from the source subvolume,
+// since Btrfs snapshots cannot be created across filesystems
+func (d *BtrfsDriver) validateSameFilesystem(sourcePath, subvolumePath string) error {
+	sourceFilesystem, err := d.getFilesystemUUID(sourcePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get filesystem of volume content source: %v", err)
+	}
+	subvolumeRoot := filepath.Dir(subvolumePath)
+	volumeFilesystem, err := d.getFilesystemUUID(subvolumeRoot)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get filesystem of subvolume root: %v", err)
+	}
+	if sourceFilesystem != volumeFilesystem {
+		return status.Errorf(codes.InvalidArgument, "volume content source %s is on btrfs filesystem %s, but subvolume root %s is on btrfs filesystem %s",
+			sourcePath, sourceFilesystem, subvolumeRoot, volumeFilesystem)
+	}
+
+	return nil
 }
 
 func (d *BtrfsDriver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
@@ -95,22 +405,114 @@ func (d *BtrfsDriver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeReq
 		return nil, err
 	}
 
-	// We rely on the fact that the volume ID is the full path to the subvolume
-	subvolumePath := req.GetVolumeId()
+	unlock, err := d.lockVolumes(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	subvolumePath, err := d.resolveVolumeID(req.GetVolumeId())
+	if errors.Is(err, errVolumeNotFound) {
+		klog.Infof("DeleteVolume: volume %s does not exist: %v", req.GetVolumeId(), err)
+		return &csi.DeleteVolumeResponse{}, nil
+	} else if errors.Is(err, errVolumeOnOtherNode) {
+		// Never report volumes of other nodes as deleted, their subvolumes would be leaked
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to resolve volume ID %s: %v", req.GetVolumeId(), err)
+	} else if err != nil {
+		return nil, resolveVolumeIDError(req.GetVolumeId(), err)
+	}
+
+	if isBtrfsSubvolume(subvolumePath) {
+		if err := d.validateDriverSubvolume(req.GetVolumeId(), subvolumePath, metadataTypeVolume); err != nil {
+			return nil, err
+		}
+	}
 
 	// Delete the Btrfs subvolume
 	if err := d.deleteBtrfsSubvolume(subvolumePath); err != nil {
-		klog.Errorf("Failed to delete btrfs subvolume %s: %v", subvolumePath, err)
-		// Don't return error - the subvolume might not exist or already be deleted
-	} else {
-		klog.Infof("DeleteVolume: deleted subvolume %s", subvolumePath)
+		return nil, status.Errorf(codes.Internal, "failed to delete volume %s: %v", req.GetVolumeId(), err)
+	}
+	klog.Infof("DeleteVolume: deleted subvolume %s", subvolumePath)
+
+	if err := d.deleteVolumeMetadata(subvolumePath); err != nil {
+		klog.Errorf("Failed to delete metadata of volume %s: %v", subvolumePath, err)
 	}
 
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
 func (d *BtrfsDriver) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.Infof("ControllerGetVolume: called with args %+v", req)
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+
+	subvolumePath, err := d.resolveVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, resolveVolumeIDError(req.GetVolumeId(), err)
+	}
+
+	metadata, err := d.readVolumeMetadata(subvolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read volume metadata: %v", err)
+	}
+
+	// A volume whose subvolume has disappeared is reported as abnormal,
+	// so that the CO can surface the problem to the user
+	if !isBtrfsSubvolume(subvolumePath) {
+		if metadata == nil || metadata.Type != metadataTypeVolume {
+			return nil, status.Errorf(codes.NotFound, "volume %s does not exist", subvolumePath)
+		}
+		return &csi.ControllerGetVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:           req.GetVolumeId(),
+				CapacityBytes:      metadata.CapacityBytes,
+				VolumeContext:      d.getVolumeContext(metadata),
+				ContentSource:      metadata.ContentSource(),
+				AccessibleTopology: d.getTopology(),
+			},
+			Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+				PublishedNodeIds: []string{},
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: true,
+					Message:  fmt.Sprintf("subvolume %s does not exist", subvolumePath),
+				},
+			},
+		}, nil
+	}
+
+	// Snapshots and subvolumes not created by the driver are no volumes
+	if err := d.validateDriverSubvolume(req.GetVolumeId(), subvolumePath, metadataTypeVolume); err != nil {
+		switch status.Code(err) {
+		case codes.InvalidArgument, codes.FailedPrecondition:
+			return nil, status.Errorf(codes.NotFound, "volume %s does not exist: %v", req.GetVolumeId(), status.Convert(err).Message())
+		default:
+			return nil, err
+		}
+	}
+
+	subvolume, err := d.getSubvolumeInfo(subvolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get subvolume info of %s: %v", subvolumePath, err)
+	}
+
+	publishedNodeIDs := []string{}
+	published, err := isSubvolumePublished(subvolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check mounts of volume %s: %v", subvolumePath, err)
+	}
+	if published {
+		publishedNodeIDs = append(publishedNodeIDs, d.nodeID)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: d.newCSIVolume(subvolume),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs,
+			VolumeCondition:  d.getVolumeCondition(subvolume),
+		},
+	}, nil
 }
 
 func (d *BtrfsDriver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
@@ -128,7 +530,24 @@ func (d *BtrfsDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.V
 		return nil, err
 	}
 
-	// For now, we support all requested capabilities
+	subvolumePath, err := d.resolveVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, resolveVolumeIDError(req.GetVolumeId(), err)
+	}
+	if !isBtrfsSubvolume(subvolumePath) {
+		return nil, status.Errorf(codes.NotFound, "volume %s does not exist", req.GetVolumeId())
+	}
+	block := d.isBlockVolume(subvolumePath)
+
+	for _, capability := range req.GetVolumeCapabilities() {
+		if (capability.GetBlock() != nil) != block {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: "access type does not match the volume mode of the volume"}, nil
+		}
+		if _, err := parseMountFlags(capability.GetMount().GetMountFlags()); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
+	}
+
 	return &csi.ValidateVolumeCapabilitiesResponse{
 		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
 			VolumeCapabilities: req.GetVolumeCapabilities(),
@@ -137,7 +556,174 @@ func (d *BtrfsDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.V
 }
 
 func (d *BtrfsDriver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.Infof("ListVolumes: called with args %+v", req)
+
+	subvolumes, volumeIDs, err := d.findVolumes()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list volumes: %v", err)
+	}
+
+	start, end, nextToken, err := paginate(volumeIDs, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "%v", err)
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, end-start)
+	for _, subvolume := range subvolumes[start:end] {
+		publishedNodeIDs := []string{}
+		published, err := isSubvolumePublished(subvolume.Path)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check mounts of volume %s: %v", subvolume.Path, err)
+		}
+		if published {
+			publishedNodeIDs = append(publishedNodeIDs, d.nodeID)
+		}
+
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: d.newCSIVolume(subvolume),
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodeIDs,
+				VolumeCondition:  d.getVolumeCondition(subvolume),
+			},
+		})
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// findVolumes returns the subvolumes and IDs of all volumes on the local node, sorted by volume ID
+func (d *BtrfsDriver) findVolumes() ([]SubvolumeInfo, []string, error) {
+	type volume struct {
+		subvolume SubvolumeInfo
+		id        string
+	}
+
+	volumes := []volume{}
+	for _, root := range d.getSubvolumeRoots() {
+		subvolumes, err := d.listSubvolumes(root)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, subvolume := range subvolumes {
+			// Read-only subvolumes are snapshots, and all other RPCs reject subvolumes the driver did not record
+			if !subvolume.ReadOnly && d.hasMetadataType(subvolume.Path, metadataTypeVolume) {
+				volumes = append(volumes, volume{subvolume, d.lookupVolumeID(subvolume.Path)})
+			}
+		}
+	}
+
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].id < volumes[j].id
+	})
+
+	subvolumes := make([]SubvolumeInfo, 0, len(volumes))
+	volumeIDs := make([]string, 0, len(volumes))
+	for _, v := range volumes {
+		subvolumes = append(subvolumes, v.subvolume)
+		volumeIDs = append(volumeIDs, v.id)
+	}
+	return subvolumes, volumeIDs, nil
+}
+
+// newCSIVolume converts the Btrfs subvolume of a volume into a CSI volume
+func (d *BtrfsDriver) newCSIVolume(subvolume SubvolumeInfo) *csi.Volume {
+	volume := &csi.Volume{
+		VolumeId:           subvolume.Path,
+		AccessibleTopology: d.getTopology(),
+	}
+
+	metadata, err := d.readVolumeMetadata(subvolume.Path)
+	if err != nil {
+		klog.Warningf("Unable to read metadata of volume %s: %v", subvolume.Path, err)
+	} else if metadata != nil {
+		if metadata.ID != "" {
+			volume.VolumeId = metadata.ID
+		}
+		volume.CapacityBytes = metadata.CapacityBytes
+		volume.VolumeContext = d.getVolumeContext(metadata)
+		volume.ContentSource = metadata.ContentSource()
+	}
+
+	// The capacity of a volume is its quota limit.
+	// Without quotas or metadata the capacity is unknown, which is indicated by 0.
+	if qgroup, err := d.getSubvolumeQgroup(subvolume.Path); err == nil {
+		if _, limit := qgroupUsage(qgroup, metadata.GetQuotaMode()); limit > 0 {
+			volume.CapacityBytes = limit
+		}
+	} else {
+		klog.V(4).Infof("Unable to determine capacity of volume %s: %v", subvolume.Path, err)
+	}
+
+	return volume
+}
+
+// getVolumeContext returns the volume context that was handed out when the volume was created
+func (d *BtrfsDriver) getVolumeContext(metadata *VolumeMetadata) map[string]string {
+	return map[string]string{
+		"storage.kubernetes.io/csiProvisionerIdentity": "btrfs-csi",
+		"targetNode": metadata.TargetNode,
+		"capacity":   strconv.FormatInt(metadata.CapacityBytes, 10),
+	}
+}
+
+// getTopology returns the topology of volumes on the local node
+func (d *BtrfsDriver) getTopology() []*csi.Topology {
+	return []*csi.Topology{
+		{
+			Segments: map[string]string{
+				"kubernetes.io/hostname": d.nodeID,
+			},
+		},
+	}
+}
+
+// getVolumeCondition checks the health of the subvolume of a volume
+func (d *BtrfsDriver) getVolumeCondition(subvolume SubvolumeInfo) *csi.VolumeCondition {
+	problems := []string{}
+
+	// Volumes are always writable, only snapshots are read-only
+	if subvolume.ReadOnly {
+		problems = append(problems, fmt.Sprintf("subvolume %s is read-only", subvolume.Path))
+	}
+
+	// Writes fail with EDQUOT once the limited data reaches the limit
+	if qgroup, err := d.getSubvolumeQgroup(subvolume.Path); err == nil {
+		used, limit := qgroupUsage(qgroup, d.getVolumeQuotaMode(subvolume.Path))
+		if limit > 0 && used >= limit {
+			problems = append(problems, fmt.Sprintf("volume has exceeded its quota (%d of %d bytes used)", used, limit))
+		}
+	} else {
+		klog.V(4).Infof("Unable to determine quota usage of volume %s: %v", subvolume.Path, err)
+	}
+
+	// The error counters are persistent until they are reset with `btrfs device stats --reset`
+	if devices, err := d.getDeviceStats(subvolume.Path); err == nil {
+		for _, device := range devices {
+			if device.Missing {
+				problems = append(problems, fmt.Sprintf("device %d of the filesystem is missing", device.DevID))
+			} else if device.Errors() > 0 {
+				problems = append(problems, fmt.Sprintf("device %s reports errors (write: %d, read: %d, flush: %d, corruption: %d, generation: %d)",
+					device.Path, device.WriteErrors, device.ReadErrors, device.FlushErrors, device.CorruptionErrors, device.GenerationErrors))
+			}
+		}
+	} else {
+		klog.Warningf("Unable to get device stats of the filesystem of volume %s: %v", subvolume.Path, err)
+	}
+
+	if len(problems) > 0 {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  strings.Join(problems, "; "),
+		}
+	}
+
+	return &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is healthy",
+	}
 }
 
 func (d *BtrfsDriver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
@@ -145,6 +731,9 @@ func (d *BtrfsDriver) GetCapacity(ctx context.Context, req *csi.GetCapacityReque
 
 	// Get available space on the Btrfs filesystem
 	subvolumeRoot := d.getSubvolumeRootFromVolumeContext(req.GetParameters())
+	if !d.isSubvolumeRoot(subvolumeRoot) {
+		return nil, status.Errorf(codes.InvalidArgument, "subvolume root %s is not one of the configured subvolume roots %v", subvolumeRoot, d.getSubvolumeRoots())
+	}
 	usage, err := d.getBtrfsFilesystemUsage(subvolumeRoot)
 	if err != nil {
 		klog.Errorf("Failed to get Btrfs filesystem usage: %v", err)
@@ -160,42 +749,11 @@ func (d *BtrfsDriver) GetCapacity(ctx context.Context, req *csi.GetCapacityReque
 func (d *BtrfsDriver) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	klog.Infof("ControllerGetCapabilities: called with args %+v", req)
 
-	capabilities := []*csi.ControllerServiceCapability{
-		{
-			Type: &csi.ControllerServiceCapability_Rpc{
-				Rpc: &csi.ControllerServiceCapability_RPC{
-					Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-				},
-			},
-		},
-		{
-			Type: &csi.ControllerServiceCapability_Rpc{
-				Rpc: &csi.ControllerServiceCapability_RPC{
-					Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
-				},
-			},
-		},
-		{
-			Type: &csi.ControllerServiceCapability_Rpc{
-				Rpc: &csi.ControllerServiceCapability_RPC{
-					Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-				},
-			},
-		},
-		{
-			Type: &csi.ControllerServiceCapability_Rpc{
-				Rpc: &csi.ControllerServiceCapability_RPC{
-					Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-				},
-			},
-		},
-		{
-			Type: &csi.ControllerServiceCapability_Rpc{
-				Rpc: &csi.ControllerServiceCapability_RPC{
-					Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-				},
-			},
-		},
+	var capabilities []*csi.ControllerServiceCapability
+	if d.isControllerService() {
+		for _, capability := range controllerCapabilities {
+			capabilities = append(capabilities, csicommon.NewControllerServiceCapability(capability))
+		}
 	}
 
 	return &csi.ControllerGetCapabilitiesResponse{
@@ -204,24 +762,325 @@ func (d *BtrfsDriver) ControllerGetCapabilities(ctx context.Context, req *csi.Co
 }
 
 func (d *BtrfsDriver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.Infof("CreateSnapshot: called with args %+v", req)
+
+	if err := d.validateCreateSnapshotRequest(req); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lockNewVolume(req.GetName(), req.GetSourceVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	sourcePath, err := d.resolveVolumeID(req.GetSourceVolumeId())
+	if err != nil {
+		return nil, resolveVolumeIDError(req.GetSourceVolumeId(), err)
+	}
+	if err := d.validateDriverSubvolume(req.GetSourceVolumeId(), sourcePath, metadataTypeVolume); err != nil {
+		return nil, err
+	}
+
+	sourceInfo, err := d.getSubvolumeInfo(sourcePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get source volume info: %v", err)
+	}
+
+	// Snapshots are placed next to their source volume, i.e. in the same subvolume root
+	subvolumeRoot := filepath.Dir(sourcePath)
+	snapshotPath := filepath.Join(subvolumeRoot, req.GetName())
+	if err := d.validateSubvolumePath(snapshotPath); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot path: %v", err)
+	}
+
+	if isBtrfsSubvolume(snapshotPath) {
+		snapshotInfo, err := d.getSubvolumeInfo(snapshotPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get snapshot info: %v", err)
+		}
+		if !snapshotInfo.ReadOnly || snapshotInfo.ParentUUID != sourceInfo.UUID {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists but is not a snapshot of volume %s", snapshotPath, sourcePath)
+		}
+		klog.Infof("CreateSnapshot: snapshot %s of volume %s already exists", snapshotPath, sourcePath)
+
+		// The driver was interrupted before it could record the snapshot
+		metadata, err := d.readVolumeMetadata(snapshotPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read snapshot metadata: %v", err)
+		}
+		if metadata == nil {
+			if err := d.writeSnapshotMetadata(req, snapshotInfo, sourcePath); err != nil {
+				return nil, err
+			}
+		}
+
+		return &csi.CreateSnapshotResponse{
+			Snapshot: d.newCSISnapshot(snapshotInfo, sourcePath),
+		}, nil
+	}
+
+	klog.Infof("CreateSnapshot: creating snapshot %s of volume %s", snapshotPath, sourcePath)
+
+	if err := d.createBtrfsSnapshot(sourcePath, snapshotPath, true); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create btrfs snapshot: %v", err)
+	}
+
+	snapshotInfo, err := d.getSubvolumeInfo(snapshotPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get snapshot info: %v", err)
+	}
+	if err := d.writeSnapshotMetadata(req, snapshotInfo, sourcePath); err != nil {
+		return nil, err
+	}
+
+	klog.Infof("CreateSnapshot: created snapshot %s of volume %s", snapshotPath, sourcePath)
+
+	return &csi.CreateSnapshotResponse{
+		Snapshot: d.newCSISnapshot(snapshotInfo, sourcePath),
+	}, nil
+}
+
+// writeSnapshotMetadata records a newly created snapshot of the volume at the source path
+func (d *BtrfsDriver) writeSnapshotMetadata(req *csi.CreateSnapshotRequest, snapshot SubvolumeInfo, sourcePath string) error {
+	snapshotID, err := d.newVolumeID(snapshot)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to determine snapshot ID: %v", err)
+	}
+
+	metadata := &VolumeMetadata{
+		ID:             snapshotID,
+		Type:           metadataTypeSnapshot,
+		Name:           req.GetName(),
+		Parameters:     req.GetParameters(),
+		SourceVolumeID: req.GetSourceVolumeId(),
+		Block:          d.isBlockVolume(sourcePath),
+		CreationTime:   time.Now().UTC(),
+	}
+	if err := d.writeVolumeMetadata(snapshot.Path, metadata); err != nil {
+		return status.Errorf(codes.Internal, "failed to write snapshot metadata: %v", err)
+	}
+	return nil
 }
 
 func (d *BtrfsDriver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.Infof("DeleteSnapshot: called with args %+v", req)
+
+	if err := d.validateDeleteSnapshotRequest(req); err != nil {
+		return nil, err
+	}
+
+	unlock, err := d.lockVolumes(req.GetSnapshotId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	snapshotPath, err := d.resolveVolumeID(req.GetSnapshotId())
+	if errors.Is(err, errVolumeNotFound) {
+		klog.Infof("DeleteSnapshot: snapshot %s does not exist: %v", req.GetSnapshotId(), err)
+		return &csi.DeleteSnapshotResponse{}, nil
+	} else if errors.Is(err, errVolumeOnOtherNode) {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to resolve snapshot ID %s: %v", req.GetSnapshotId(), err)
+	} else if err != nil {
+		return nil, resolveVolumeIDError(req.GetSnapshotId(), err)
+	}
+	if !isBtrfsSubvolume(snapshotPath) {
+		klog.Infof("DeleteSnapshot: snapshot %s does not exist", snapshotPath)
+		if err := d.deleteVolumeMetadata(snapshotPath); err != nil {
+			klog.Errorf("Failed to delete metadata of snapshot %s: %v", snapshotPath, err)
+		}
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	if err := d.validateDriverSubvolume(req.GetSnapshotId(), snapshotPath, metadataTypeSnapshot); err != nil {
+		return nil, err
+	}
+
+	if err := d.deleteBtrfsSubvolume(snapshotPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete btrfs snapshot: %v", err)
+	}
+	if err := d.deleteVolumeMetadata(snapshotPath); err != nil {
+		klog.Errorf("Failed to delete metadata of snapshot %s: %v", snapshotPath, err)
+	}
+
+	klog.Infof("DeleteSnapshot: deleted snapshot %s", snapshotPath)
+
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (d *BtrfsDriver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.Infof("ListSnapshots: called with args %+v", req)
+
+	snapshots, err := d.findSnapshots(req.GetSnapshotId(), req.GetSourceVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list snapshots: %v", err)
+	}
+
+	snapshotIDs := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		snapshotIDs = append(snapshotIDs, snapshot.GetSnapshotId())
+	}
+
+	start, end, nextToken, err := paginate(snapshotIDs, req.GetStartingToken(), req.GetMaxEntries())
+	if err != nil {
+		return nil, status.Errorf(codes.Aborted, "%v", err)
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, end-start)
+	for _, snapshot := range snapshots[start:end] {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snapshot,
+		})
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// findSnapshots returns all snapshots matching the given (optional) snapshot ID and source volume ID,
+// sorted by snapshot ID
+func (d *BtrfsDriver) findSnapshots(snapshotID, sourceVolumeID string) ([]*csi.Snapshot, error) {
+	snapshots := []*csi.Snapshot{}
+
+	// Snapshots and volumes of other nodes or with unknown IDs are simply not listed
+	var snapshotPath, sourcePath string
+	if snapshotID != "" {
+		path, err := d.resolveVolumeID(snapshotID)
+		if errors.Is(err, errVolumeNotFound) || errors.Is(err, errVolumeOnOtherNode) {
+			return snapshots, nil
+		} else if err != nil {
+			return nil, err
+		}
+		snapshotPath = path
+	}
+	if sourceVolumeID != "" {
+		path, err := d.resolveVolumeID(sourceVolumeID)
+		if errors.Is(err, errVolumeNotFound) || errors.Is(err, errVolumeOnOtherNode) {
+			return snapshots, nil
+		} else if err != nil {
+			return nil, err
+		}
+		sourcePath = path
+	}
+
+	// Only look at the requested snapshot
+	if snapshotPath != "" {
+		if !isBtrfsSubvolume(snapshotPath) {
+			return snapshots, nil
+		}
+		info, err := d.getSubvolumeInfo(snapshotPath)
+		if err != nil {
+			return nil, err
+		}
+		if !info.ReadOnly || !d.hasMetadataType(snapshotPath, metadataTypeSnapshot) {
+			return snapshots, nil
+		}
+		snapshotSourcePath, err := d.findSnapshotSource(info)
+		if err != nil {
+			return nil, err
+		}
+		if sourcePath == "" || sourcePath == snapshotSourcePath {
+			snapshots = append(snapshots, d.newCSISnapshot(info, snapshotSourcePath))
+		}
+		return snapshots, nil
+	}
+
+	// Only look at the subvolume root of the requested source volume
+	roots := d.getSubvolumeRoots()
+	if sourcePath != "" {
+		if !isBtrfsSubvolume(sourcePath) {
+			return snapshots, nil
+		}
+		roots = []string{filepath.Dir(sourcePath)}
+	}
+
+	for _, root := range roots {
+		subvolumes, err := d.listSubvolumes(root)
+		if err != nil {
+			return nil, err
+		}
+
+		uuids := map[string]string{}
+		for _, subvolume := range subvolumes {
+			uuids[subvolume.UUID] = subvolume.Path
+		}
+
+		for _, subvolume := range subvolumes {
+			// Only list read-only subvolumes the driver recorded as snapshots, all other RPCs reject the rest
+			if !subvolume.ReadOnly || !d.hasMetadataType(subvolume.Path, metadataTypeSnapshot) {
+				continue
+			}
+			snapshotSourcePath := uuids[subvolume.ParentUUID]
+			if sourcePath != "" && sourcePath != snapshotSourcePath {
+				continue
+			}
+			snapshots = append(snapshots, d.newCSISnapshot(subvolume, snapshotSourcePath))
+		}
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].GetSnapshotId() < snapshots[j].GetSnapshotId()
+	})
+	return snapshots, nil
+}
+
+// findSnapshotSource returns the path of the volume the given snapshot was taken from
+// (empty if the source volume no longer exists)
+func (d *BtrfsDriver) findSnapshotSource(snapshot SubvolumeInfo) (string, error) {
+	if snapshot.ParentUUID == "" {
+		return "", nil
+	}
+
+	subvolumes, err := d.listSubvolumes(filepath.Dir(snapshot.Path))
+	if err != nil {
+		return "", err
+	}
+	for _, subvolume := range subvolumes {
+		if subvolume.UUID == snapshot.ParentUUID {
+			return subvolume.Path, nil
+		}
+	}
+
+	return "", nil
+}
+
+// newCSISnapshot converts a Btrfs snapshot subvolume into a CSI snapshot
+func (d *BtrfsDriver) newCSISnapshot(snapshot SubvolumeInfo, sourcePath string) *csi.Snapshot {
+	// The size of a snapshot is the amount of data it references.
+	// Without quotas the size is unknown, which is indicated by 0.
+	var sizeBytes int64
+	if qgroup, err := d.getSubvolumeQgroup(snapshot.Path); err == nil {
+		sizeBytes = qgroup.Referenced
+	} else {
+		klog.V(4).Infof("Unable to determine size of snapshot %s: %v", snapshot.Path, err)
+	}
+
+	// The source volume may have been deleted since, only snapshots adopted from older versions of the driver
+	// have no record of it
+	var sourceVolumeID string
+	if metadata, err := d.readVolumeMetadata(snapshot.Path); err == nil && metadata != nil && metadata.SourceVolumeID != "" {
+		sourceVolumeID = metadata.SourceVolumeID
+	} else if sourcePath != "" {
+		sourceVolumeID = d.lookupVolumeID(sourcePath)
+	}
+
+	return &csi.Snapshot{
+		SnapshotId:     d.lookupVolumeID(snapshot.Path),
+		SourceVolumeId: sourceVolumeID,
+		SizeBytes:      sizeBytes,
+		CreationTime:   timestamppb.New(snapshot.CreationTime),
+		ReadyToUse:     true,
+	}
 }
 
 func (d *BtrfsDriver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	klog.Infof("ControllerExpandVolume: called with args %+v", req)
 
-	subvolumePath := req.GetVolumeId()
-
 	// Validate the request
-	if subvolumePath == "" {
+	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
 	}
 
@@ -230,24 +1089,75 @@ func (d *BtrfsDriver) ControllerExpandVolume(ctx context.Context, req *csi.Contr
 		return nil, status.Error(codes.InvalidArgument, "capacity range is required")
 	}
 
-	newCapacityBytes := capacityRange.GetRequiredBytes()
-	if newCapacityBytes <= 0 {
+	if capacityRange.GetRequiredBytes() <= 0 {
 		return nil, status.Error(codes.InvalidArgument, "required bytes must be greater than 0")
 	}
 
-	klog.Infof("ControllerExpandVolume: expanding volume %s to %d bytes", subvolumePath, newCapacityBytes)
+	unlock, err := d.lockVolumes(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	subvolumePath, err := d.resolveVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, resolveVolumeIDError(req.GetVolumeId(), err)
+	}
 
-	// Check if subvolume exists
-	if _, err := os.Stat(subvolumePath); os.IsNotExist(err) {
-		return nil, status.Errorf(codes.NotFound, "subvolume %s does not exist", subvolumePath)
+	if err := d.validateDriverSubvolume(req.GetVolumeId(), subvolumePath, metadataTypeVolume); err != nil {
+		return nil, err
+	}
+
+	newCapacityBytes, err := getCapacity(capacityRange, d.getSectorSize(subvolumePath))
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "unsupported capacity range: %v", err)
+	}
+
+	metadata, err := d.readVolumeMetadata(subvolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to read volume metadata: %v", err)
 	}
 
-	// Update the quota for the subvolume
-	if err := d.setSubvolumeQuota(subvolumePath, newCapacityBytes); err != nil {
+	// Volumes are never shrunk: if the volume is already large enough, report its current capacity
+	var currentCapacityBytes int64
+	if metadata != nil {
+		currentCapacityBytes = metadata.CapacityBytes
+	}
+	currentCapacityBytes = d.getAppliedCapacity(subvolumePath, metadata.GetQuotaMode(), currentCapacityBytes)
+	if currentCapacityBytes >= newCapacityBytes {
+		if !capacityInRange(currentCapacityBytes, capacityRange) {
+			return nil, status.Errorf(codes.OutOfRange, "volume %s already has capacity %d bytes, which exceeds the limit of %d bytes",
+				subvolumePath, currentCapacityBytes, capacityRange.GetLimitBytes())
+		}
+		klog.Infof("ControllerExpandVolume: volume %s already has capacity %d bytes", subvolumePath, currentCapacityBytes)
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         currentCapacityBytes,
+			NodeExpansionRequired: true,
+		}, nil
+	}
+
+	klog.Infof("ControllerExpandVolume: expanding volume %s to %d bytes", subvolumePath, newCapacityBytes)
+
+	if metadata != nil && metadata.Block {
+		// Grow the image of the raw block volume, the node updates the capacity of its loop devices
+		if err := resizeBlockImage(subvolumePath, newCapacityBytes, metadata.Preallocated); err != nil {
+			klog.Errorf("Failed to expand image of volume %s to %d bytes: %v", subvolumePath, newCapacityBytes, err)
+			return nil, status.Errorf(codes.Internal, "failed to expand volume: %v", err)
+		}
+	} else if err := d.setSubvolumeQuota(subvolumePath, newCapacityBytes, metadata.GetQuotaMode()); err != nil {
+		// Update the quota for the subvolume, limiting the same bytes as when the volume was created
 		klog.Errorf("Failed to expand subvolume %s to %d bytes: %v", subvolumePath, newCapacityBytes, err)
 		return nil, status.Errorf(codes.Internal, "failed to expand volume: %v", err)
 	}
 
+	newCapacityBytes = d.getAppliedCapacity(subvolumePath, metadata.GetQuotaMode(), newCapacityBytes)
+	if metadata != nil {
+		metadata.CapacityBytes = newCapacityBytes
+		if err := d.writeVolumeMetadata(subvolumePath, metadata); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to write volume metadata: %v", err)
+		}
+	}
+
 	klog.Infof("ControllerExpandVolume: successfully expanded volume %s to %d bytes", subvolumePath, newCapacityBytes)
 
 	return &csi.ControllerExpandVolumeResponse{
@@ -269,10 +1179,21 @@ func (d *BtrfsDriver) validateCreateVolumeRequest(req *csi.CreateVolumeRequest)
 		return status.Error(codes.InvalidArgument, "volume name is required")
 	}
 
+	if err := validateSubvolumeName(req.GetName()); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid volume name: %v", err)
+	}
+
 	if req.GetCapacityRange() == nil {
 		return status.Error(codes.InvalidArgument, "capacity range is required")
 	}
 
+	// Reject unsupported mount flags before the volume is created, instead of when it is published
+	for _, capability := range req.GetVolumeCapabilities() {
+		if _, err := parseMountFlags(capability.GetMount().GetMountFlags()); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid mount flags: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -284,6 +1205,30 @@ func (d *BtrfsDriver) validateDeleteVolumeRequest(req *csi.DeleteVolumeRequest)
 	return nil
 }
 
+func (d *BtrfsDriver) validateCreateSnapshotRequest(req *csi.CreateSnapshotRequest) error {
+	if req.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "snapshot name is required")
+	}
+
+	if err := validateSubvolumeName(req.GetName()); err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid snapshot name: %v", err)
+	}
+
+	if req.GetSourceVolumeId() == "" {
+		return status.Error(codes.InvalidArgument, "source volume ID is required")
+	}
+
+	return nil
+}
+
+func (d *BtrfsDriver) validateDeleteSnapshotRequest(req *csi.DeleteSnapshotRequest) error {
+	if req.GetSnapshotId() == "" {
+		return status.Error(codes.InvalidArgument, "snapshot ID is required")
+	}
+
+	return nil
+}
+
 func (d *BtrfsDriver) validateValidateVolumeCapabilitiesRequest(req *csi.ValidateVolumeCapabilitiesRequest) error {
 	if req.GetVolumeId() == "" {
 		return status.Error(codes.InvalidArgument, "volume ID is required")
@@ -298,13 +1243,9 @@ func (d *BtrfsDriver) validateValidateVolumeCapabilitiesRequest(req *csi.Validat
 
 // getSubvolumeRootFromVolumeContext extracts the subvolume root path from volume context
 func (d *BtrfsDriver) getSubvolumeRootFromVolumeContext(volumeContext map[string]string) string {
-	if volumeContext == nil {
-		return DefaultBtrfsPath // default fallback
-	}
-
-	if subvolumeRoot, exists := volumeContext["subvolumeRoot"]; exists && subvolumeRoot != "" {
-		return subvolumeRoot
+	if subvolumeRoot, exists := volumeContext[subvolumeRootParameter]; exists && subvolumeRoot != "" {
+		return filepath.Clean(subvolumeRoot)
 	}
 
-	return DefaultBtrfsPath // default fallback
+	return d.subvolumeRoots[0] // default fallback
 }
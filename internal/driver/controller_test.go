@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TestValidateExistingVolumeSubvolumeRoot verifies that a volume with the requested name in another
+// subvolume root is neither returned nor created a second time
+func TestValidateExistingVolumeSubvolumeRoot(t *testing.T) {
+	d := &BtrfsDriver{subvolumeRoots: []string{"/var/lib/btrfs-csi", "/mnt/data"}}
+
+	tests := []struct {
+		name       string
+		path       string
+		parameters map[string]string
+	}{
+		{
+			name:       "requested root",
+			path:       "/var/lib/btrfs-csi/pvc-1",
+			parameters: map[string]string{subvolumeRootParameter: "/mnt/data"},
+		},
+		{
+			name:       "default root",
+			path:       "/mnt/data/pvc-1",
+			parameters: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		requested := &VolumeMetadata{Type: metadataTypeVolume, Name: "pvc-1", Parameters: tt.parameters}
+		err := d.validateExistingVolume(tt.path, requested, &csi.CapacityRange{})
+		if status.Code(err) != codes.AlreadyExists {
+			t.Errorf("Expected AlreadyExists for a volume outside of the %s, got: %v", tt.name, err)
+		}
+	}
+}
+
+func TestValidateCreateSnapshotRequest(t *testing.T) {
+	d := &BtrfsDriver{}
+
+	tests := []struct {
+		name     string
+		req      *csi.CreateSnapshotRequest
+		expected codes.Code
+	}{
+		{name: "valid", req: &csi.CreateSnapshotRequest{Name: "snapshot-1", SourceVolumeId: "v2:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:256"}, expected: codes.OK},
+		{name: "missing name", req: &csi.CreateSnapshotRequest{SourceVolumeId: "v2:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:256"}, expected: codes.InvalidArgument},
+		{name: "path as name", req: &csi.CreateSnapshotRequest{Name: "../snapshot-1", SourceVolumeId: "v2:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:256"}, expected: codes.InvalidArgument},
+		{name: "missing source volume", req: &csi.CreateSnapshotRequest{Name: "snapshot-1"}, expected: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := status.Code(d.validateCreateSnapshotRequest(tt.req)); code != tt.expected {
+				t.Errorf("Expected %s, got %s", tt.expected, code)
+			}
+		})
+	}
+
+	if code := status.Code(d.validateDeleteSnapshotRequest(&csi.DeleteSnapshotRequest{})); code != codes.InvalidArgument {
+		t.Errorf("Expected %s for missing snapshot ID, got %s", codes.InvalidArgument, code)
+	}
+}
+
+// TestNewCreatedCSIVolumeCapacity verifies that CreateVolume reports the capacity recorded for the volume,
+// which is the applied quota limit, in the response and the volume context
+func TestNewCreatedCSIVolumeCapacity(t *testing.T) {
+	d := &BtrfsDriver{}
+	metadata := &VolumeMetadata{
+		ID:            "v2:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:256",
+		CapacityBytes: 1610612736,
+		TargetNode:    "node-1",
+	}
+
+	volume := d.newCreatedCSIVolume(metadata, nil)
+	if volume.GetCapacityBytes() != metadata.CapacityBytes {
+		t.Errorf("Expected capacity %d, got %d", metadata.CapacityBytes, volume.GetCapacityBytes())
+	}
+	if capacity := volume.GetVolumeContext()["capacity"]; capacity != "1610612736" {
+		t.Errorf("Expected capacity 1610612736 in volume context, got %q", capacity)
+	}
+}
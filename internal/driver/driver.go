@@ -1,10 +1,20 @@
 package driver
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 
+	"github.com/btrfs-csi/driver/internal/btrfs"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"google.golang.org/grpc"
 	"k8s.io/klog/v2"
 )
 
@@ -14,16 +24,124 @@ const (
 	Version    = "0.0.1"
 )
 
+// Mode selects which CSI services the driver serves
+type Mode string
+
+const (
+	ModeController Mode = "controller"
+	ModeNode       Mode = "node"
+	ModeAll        Mode = "all"
+)
+
+// controllerCapabilities are the RPCs supported by the controller service
+var controllerCapabilities = []csi.ControllerServiceCapability_RPC_Type{
+	csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	csi.ControllerServiceCapability_RPC_GET_VOLUME,
+	csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+	csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+	csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+	csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+}
+
 type BtrfsDriver struct {
 	*csicommon.CSIDriver
 	nodeID       string
 	endpoint     string
+	mode         Mode
 	btrfsManager *BtrfsManager
+
+	// metricsAddress is the address of the Prometheus metrics endpoint (disabled if empty)
+	metricsAddress string
+	// healthAddress is the address of the /healthz and /livez endpoints (disabled if empty)
+	healthAddress string
+
+	// enableQuotas and requireQuotas are the defaults of the corresponding StorageClass parameters
+	enableQuotas  QuotaAccounting
+	requireQuotas bool
+
+	// subvolumeRoots contains the directories in which volumes and snapshots may be created.
+	// The driver refuses to operate on subvolumes outside of these directories.
+	subvolumeRoots []string
+	// adoptLegacy records subvolumes without metadata as legacy volumes and snapshots
+	adoptLegacy bool
+
+	// volumeLocks prevents concurrent operations on the same volume or snapshot
+	volumeLocks *VolumeLocks
+
+	// diskUsages and inodeCounts cache the results of walking the files of volumes for NodeGetVolumeStats
+	diskUsages  *usageCache[int64]
+	inodeCounts *usageCache[int64]
+	// compressionStats caches the compression statistics of volumes for NodeGetVolumeStats and the metrics
+	compressionStats *usageCache[btrfs.CompressionStats]
 }
 
-func NewBtrfsDriver(nodeID, endpoint string) (*BtrfsDriver, error) {
+// DriverOptions contains the optional configuration of the driver
+type DriverOptions struct {
+	// SubvolumeRoots are the host directories in which volumes may be created (default: DefaultBtrfsPath).
+	// The first root is used for StorageClasses without a subvolumeRoot parameter.
+	SubvolumeRoots []string
+
+	// Mode selects whether the controller service, the node service or both are served (default: ModeAll)
+	Mode Mode
+
+	// MetricsAddress is the address on which Prometheus metrics are served, e.g. ":9808" (disabled if empty)
+	MetricsAddress string
+
+	// HealthAddress is the address on which the /healthz and /livez endpoints are served, e.g. ":9809" (disabled if empty).
+	// It may be the same as MetricsAddress.
+	HealthAddress string
+
+	// EnableQuotas enables the given quota accounting on the filesystem of a subvolume root
+	// when the first volume is created in it (default: QuotaAccountingNone).
+	// It can be overridden with the enableQuotas StorageClass parameter.
+	EnableQuotas QuotaAccounting
+
+	// RequireQuotas fails CreateVolume instead of creating volumes without a quota limit.
+	// It can be overridden with the requireQuotas StorageClass parameter.
+	RequireQuotas bool
+
+	// AdoptLegacyVolumes records subvolumes without metadata in the subvolume roots at startup and when they are
+	// used by their path ID, so that volumes created by versions of the driver without metadata store can still be used.
+	AdoptLegacyVolumes bool
+}
+
+func NewBtrfsDriver(nodeID, endpoint string, options DriverOptions) (*BtrfsDriver, error) {
 	klog.Infof("Driver: %v version: %v", DriverName, Version)
 
+	subvolumeRoots := options.SubvolumeRoots
+	if len(subvolumeRoots) == 0 {
+		subvolumeRoots = []string{DefaultBtrfsPath}
+	}
+	for _, root := range subvolumeRoots {
+		if !filepath.IsAbs(root) || filepath.Clean(root) != root || root == "/" {
+			return nil, fmt.Errorf("subvolume root %q must be a clean absolute path below /", root)
+		}
+	}
+
+	if err := validateNodeID(nodeID); err != nil {
+		return nil, err
+	}
+
+	mode := options.Mode
+	if mode == "" {
+		mode = ModeAll
+	}
+	if mode != ModeController && mode != ModeNode && mode != ModeAll {
+		return nil, fmt.Errorf("invalid mode %q, must be one of %q, %q or %q", mode, ModeController, ModeNode, ModeAll)
+	}
+
+	enableQuotas := options.EnableQuotas
+	if enableQuotas == "" {
+		enableQuotas = QuotaAccountingNone
+	}
+	if _, err := parseQuotaAccounting(string(enableQuotas)); err != nil {
+		return nil, err
+	}
+
 	csiDriver := csicommon.NewCSIDriver(DriverName, Version, nodeID)
 	if csiDriver == nil {
 		return nil, fmt.Errorf("failed to initialize CSI Driver")
@@ -35,32 +153,139 @@ func NewBtrfsDriver(nodeID, endpoint string) (*BtrfsDriver, error) {
 	})
 
 	btrfsDriver := &BtrfsDriver{
-		CSIDriver: csiDriver,
-		nodeID:    nodeID,
-		endpoint:  endpoint,
+		CSIDriver:        csiDriver,
+		nodeID:           nodeID,
+		endpoint:         endpoint,
+		mode:             mode,
+		metricsAddress:   options.MetricsAddress,
+		healthAddress:    options.HealthAddress,
+		enableQuotas:     enableQuotas,
+		requireQuotas:    options.RequireQuotas,
+		subvolumeRoots:   subvolumeRoots,
+		adoptLegacy:      options.AdoptLegacyVolumes,
+		volumeLocks:      NewVolumeLocks(),
+		diskUsages:       newUsageCache[int64](usageCacheTTL),
+		inodeCounts:      newUsageCache[int64](usageCacheTTL),
+		compressionStats: newUsageCache[btrfs.CompressionStats](usageCacheTTL),
 	}
+	klog.Infof("Subvolume roots: %v", subvolumeRoots)
 
-	// Advertise controller capabilities
-	btrfsDriver.CSIDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
-		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_GET_VOLUME,
-		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-	})
-	klog.Infof("Initialized as controller service")
+	if btrfsDriver.isControllerService() {
+		// Advertise controller capabilities
+		btrfsDriver.CSIDriver.AddControllerServiceCapabilities(controllerCapabilities)
+		klog.Infof("Initialized as controller service")
+	}
 
-	// Initialize node service
+	// Both services operate on the local btrfs filesystems
 	if err := btrfsDriver.initBtrfsManager(); err != nil {
 		return nil, fmt.Errorf("failed to initialize Btrfs manager: %v", err)
 	}
-	klog.Infof("Initialized as node service with Btrfs support")
+
+	if btrfsDriver.adoptLegacy {
+		btrfsDriver.adoptLegacyVolumes()
+	}
+
+	if btrfsDriver.isNodeService() {
+		klog.Infof("Initialized as node service with Btrfs support")
+	}
 
 	return btrfsDriver, nil
 }
 
 func (d *BtrfsDriver) Run() error {
-	s := csicommon.NewNonBlockingGRPCServer()
-	s.Start(d.endpoint, d, d, d)
-	s.Wait()
-	return nil
+	d.serveHTTP()
+
+	proto, addr, err := csicommon.ParseEndpoint(d.endpoint)
+	if err != nil {
+		return err
+	}
+	if proto == "unix" {
+		addr = "/" + addr
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %v", addr, err)
+		}
+	}
+
+	listener, err := net.Listen(proto, addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", d.endpoint, err)
+	}
+
+	server := grpc.NewServer(grpc.ChainUnaryInterceptor(logGRPC, observeGRPC))
+
+	// Only register the services of the configured mode, so that the other RPCs return UNIMPLEMENTED
+	csi.RegisterIdentityServer(server, d)
+	if d.isControllerService() {
+		csi.RegisterControllerServer(server, d)
+	}
+	if d.isNodeService() {
+		csi.RegisterNodeServer(server, d)
+	}
+
+	klog.Infof("Listening for connections on address: %#v", listener.Addr())
+	return server.Serve(listener)
+}
+
+// serveHTTP starts the HTTP servers of the metrics and health endpoints in the background
+func (d *BtrfsDriver) serveHTTP() {
+	muxes := map[string]*http.ServeMux{}
+	getMux := func(address string) *http.ServeMux {
+		if _, ok := muxes[address]; !ok {
+			muxes[address] = http.NewServeMux()
+		}
+		return muxes[address]
+	}
+
+	if d.metricsAddress != "" {
+		getMux(d.metricsAddress).Handle("/metrics", d.newMetricsHandler())
+		klog.Infof("Serving metrics on %s/metrics", d.metricsAddress)
+	}
+	if d.healthAddress != "" {
+		getMux(d.healthAddress).HandleFunc("/healthz", d.serveHealthz)
+		getMux(d.healthAddress).HandleFunc("/livez", d.serveLivez)
+		klog.Infof("Serving health checks on %s/healthz and %s/livez", d.healthAddress, d.healthAddress)
+	}
+
+	for address, mux := range muxes {
+		go func() {
+			if err := http.ListenAndServe(address, mux); err != nil {
+				klog.Errorf("Failed to serve HTTP on %s: %v", address, err)
+			}
+		}()
+	}
+}
+
+// logGRPC is a gRPC interceptor that logs all RPCs with secrets removed
+func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	klog.V(3).Infof("GRPC call: %s", info.FullMethod)
+	klog.V(5).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	resp, err := handler(ctx, req)
+	if err != nil {
+		klog.Errorf("GRPC error: %v", err)
+	} else {
+		klog.V(5).Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+	}
+	return resp, err
+}
+
+// isControllerService checks whether the driver serves the CSI controller service
+func (d *BtrfsDriver) isControllerService() bool {
+	return d.mode == ModeController || d.mode == ModeAll
+}
+
+// isNodeService checks whether the driver serves the CSI node service
+func (d *BtrfsDriver) isNodeService() bool {
+	return d.mode == ModeNode || d.mode == ModeAll
+}
+
+// getSubvolumeRoots returns all configured subvolume roots in sorted order
+func (d *BtrfsDriver) getSubvolumeRoots() []string {
+	roots := slices.Clone(d.subvolumeRoots)
+	sort.Strings(roots)
+	return roots
+}
+
+// isSubvolumeRoot checks whether the given path is one of the configured subvolume roots
+func (d *BtrfsDriver) isSubvolumeRoot(path string) bool {
+	return slices.Contains(d.subvolumeRoots, path)
 }
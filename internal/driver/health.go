@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/btrfs-csi/driver/internal/btrfs"
+	"k8s.io/klog/v2"
+)
+
+// checkReadiness verifies that the driver is able to manage volumes on this node.
+// It returns the reason why the driver is not ready, or nil if it is.
+func (d *BtrfsDriver) checkReadiness() error {
+	// All host paths are accessed through the host filesystem
+	if info, err := os.Stat(hostRoot); err != nil {
+		return fmt.Errorf("host filesystem is not mounted at %s: %v", hostRoot, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("host filesystem is not mounted at %s: not a directory", hostRoot)
+	}
+
+	for _, root := range d.getSubvolumeRoots() {
+		if err := d.checkSubvolumeRoot(root); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSubvolumeRoot verifies that the given subvolume root is located on a Btrfs filesystem,
+// that the Btrfs ioctls used by the driver work on it and that quotas are enabled if they are required
+func (d *BtrfsDriver) checkSubvolumeRoot(root string) error {
+	isBtrfs, err := btrfs.IsBtrfs(hostPath(root))
+	if err != nil {
+		return fmt.Errorf("subvolume root %s is not accessible: %v", root, err)
+	}
+	if !isBtrfs {
+		return fmt.Errorf("subvolume root %s is not on a Btrfs filesystem", root)
+	}
+
+	if _, err := btrfs.GetFilesystemInfo(hostPath(root)); err != nil {
+		return fmt.Errorf("btrfs ioctls are not usable on subvolume root %s: %v", root, err)
+	}
+
+	accounting, err := d.getQuotaAccounting(root)
+	if err != nil {
+		return fmt.Errorf("failed to get quota status of subvolume root %s: %v", root, err)
+	}
+	// Without quotas volumes can still be created, but their capacity is not enforced,
+	// unless quotas are required and the driver is not configured to enable them itself
+	if accounting == QuotaAccountingNone && d.requireQuotas && d.enableQuotas == QuotaAccountingNone {
+		return fmt.Errorf("quotas are required but not enabled on the filesystem of subvolume root %s", root)
+	}
+	klog.V(4).Infof("Subvolume root %s uses quota accounting %s", root, accounting)
+	return nil
+}
+
+// serveHealthz reports whether the driver is ready, for use as an HTTP readiness probe
+func (d *BtrfsDriver) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := d.checkReadiness(); err != nil {
+		klog.Warningf("Health check failed: %v", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveLivez reports that the driver is running, for use as an HTTP liveness probe.
+// It does not check the host filesystem, so that the kubelet does not restart the driver
+// while e.g. a subvolume root is not mounted yet, which a restart would not fix.
+func (d *BtrfsDriver) serveLivez(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
@@ -1,18 +1,103 @@
 package driver
 
 import (
-	"os/exec"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
 
-	"k8s.io/klog/v2"
+	"github.com/container-storage-interface/spec/lib/go/csi"
 )
 
-func execWithLog(args ...string) (*exec.Cmd) {
-	klog.V(6).Info("Executing command: ", args)
-	if len(args) == 0 {
-		return nil
+// paginate returns the range [start, end) of a sorted list of IDs for the starting token and
+// maximum number of entries of a List* request, as well as the token for the next page
+// (empty if there are no more entries).
+// Tokens refer to the last ID of the previous page, so that pages remain stable
+// when entries are added or removed between requests.
+func paginate(ids []string, startingToken string, maxEntries int32) (int, int, string, error) {
+	if maxEntries < 0 {
+		return 0, 0, "", fmt.Errorf("max entries must not be negative")
 	}
-	if len(args) == 1 {
-		return exec.Command(args[0])
+
+	start := 0
+	if startingToken != "" {
+		lastID, err := decodePageToken(startingToken)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		start = sort.Search(len(ids), func(i int) bool {
+			return ids[i] > lastID
+		})
+	}
+
+	end := len(ids)
+	if maxEntries > 0 && start+int(maxEntries) < len(ids) {
+		end = start + int(maxEntries)
+	}
+
+	nextToken := ""
+	if end < len(ids) {
+		nextToken = encodePageToken(ids[end-1])
+	}
+
+	return start, end, nextToken, nil
+}
+
+// pageTokenPrefix is the version prefix of page tokens
+const pageTokenPrefix = "v1:"
+
+// encodePageToken encodes the last ID of a page into an opaque page token
+func encodePageToken(lastID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(pageTokenPrefix + lastID))
+}
+
+// decodePageToken decodes an opaque page token into the last ID of the previous page
+func decodePageToken(token string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || !strings.HasPrefix(string(decoded), pageTokenPrefix) {
+		return "", fmt.Errorf("invalid starting token %q", token)
+	}
+	return strings.TrimPrefix(string(decoded), pageTokenPrefix), nil
+}
+
+// getCapacity returns the capacity of a volume for the given capacity range, which becomes its quota limit.
+// The required bytes are rounded up to a multiple of the granularity (the sector size of the filesystem),
+// unless that would exceed the limit bytes, in which case the limit itself is used.
+// If only limit bytes are given, they are rounded down to the granularity.
+// A capacity of 0 means that no capacity was requested and the volume is unlimited.
+func getCapacity(capacityRange *csi.CapacityRange, granularity int64) (int64, error) {
+	required := capacityRange.GetRequiredBytes()
+	limit := capacityRange.GetLimitBytes()
+
+	if required < 0 || limit < 0 {
+		return 0, fmt.Errorf("required bytes %d and limit bytes %d must not be negative", required, limit)
+	}
+	if limit > 0 && required > limit {
+		return 0, fmt.Errorf("required bytes %d exceed limit bytes %d", required, limit)
+	}
+	if granularity <= 0 {
+		granularity = 1
+	}
+
+	if required == 0 {
+		if rounded := limit / granularity * granularity; rounded > 0 {
+			return rounded, nil
+		}
+		return limit, nil
+	}
+
+	capacity := (required + granularity - 1) / granularity * granularity
+	if limit > 0 && capacity > limit {
+		capacity = limit
+	}
+	return capacity, nil
+}
+
+// capacityInRange returns whether an existing capacity satisfies the given capacity range
+func capacityInRange(capacity int64, capacityRange *csi.CapacityRange) bool {
+	if capacity < capacityRange.GetRequiredBytes() {
+		return false
 	}
-	return exec.Command(args[0], args[1:]...)
+	limit := capacityRange.GetLimitBytes()
+	return limit == 0 || (capacity > 0 && capacity <= limit)
 }
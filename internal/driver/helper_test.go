@@ -0,0 +1,147 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestPaginate(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e"}
+
+	tests := []struct {
+		name          string
+		ids           []string
+		startingToken string
+		maxEntries    int32
+		start         int
+		end           int
+		nextToken     string
+		expectError   bool
+	}{
+		{name: "all entries", ids: ids, start: 0, end: 5},
+		{name: "first page", ids: ids, maxEntries: 2, start: 0, end: 2, nextToken: encodePageToken("b")},
+		{name: "middle page", ids: ids, startingToken: encodePageToken("b"), maxEntries: 2, start: 2, end: 4, nextToken: encodePageToken("d")},
+		{name: "last page", ids: ids, startingToken: encodePageToken("d"), maxEntries: 2, start: 4, end: 5},
+		{name: "exact page", ids: ids[:4], startingToken: encodePageToken("b"), maxEntries: 2, start: 2, end: 4},
+		{name: "deleted last entry", ids: []string{"a", "c", "d"}, startingToken: encodePageToken("b"), maxEntries: 2, start: 1, end: 3},
+		{name: "token past end", ids: ids, startingToken: encodePageToken("z"), start: 5, end: 5},
+		{name: "empty list", ids: nil, start: 0, end: 0},
+		{name: "invalid token", ids: ids, startingToken: "invalid-token", expectError: true},
+		{name: "negative max entries", ids: ids, maxEntries: -1, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end, nextToken, err := paginate(tt.ids, tt.startingToken, tt.maxEntries)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("Expected error, got range [%d, %d)", start, end)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if start != tt.start || end != tt.end {
+				t.Errorf("Expected range [%d, %d), got [%d, %d)", tt.start, tt.end, start, end)
+			}
+			if nextToken != tt.nextToken {
+				t.Errorf("Expected next token %q, got %q", tt.nextToken, nextToken)
+			}
+		})
+	}
+}
+
+func TestPageToken(t *testing.T) {
+	// Snapshot and volume IDs contain colons, which must survive the round-trip
+	id := "v2:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:256"
+	decoded, err := decodePageToken(encodePageToken(id))
+	if err != nil {
+		t.Fatalf("decodePageToken failed: %v", err)
+	}
+	if decoded != id {
+		t.Errorf("Expected %s, got %s", id, decoded)
+	}
+
+	// "djI6YQ" is a token with an unknown version prefix ("v2:a")
+	for _, token := range []string{"", "!", "djI6YQ"} {
+		if _, err := decodePageToken(token); err == nil {
+			t.Errorf("Expected error for token %q", token)
+		}
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+
+	tests := []struct {
+		name        string
+		required    int64
+		limit       int64
+		capacity    int64
+		expectError bool
+	}{
+		{name: "unlimited", capacity: 0},
+		{name: "aligned", required: gib, capacity: gib},
+		{name: "rounded up", required: gib + 1, capacity: gib + 4096},
+		{name: "fractional gibibytes", required: 3 * gib / 2, capacity: 3 * gib / 2},
+		{name: "rounded up within limit", required: 1000, limit: 8192, capacity: 4096},
+		{name: "rounding capped at limit", required: 1000, limit: 2000, capacity: 2000},
+		{name: "required equals limit", required: 5000, limit: 5000, capacity: 5000},
+		{name: "only limit", limit: gib + 100, capacity: gib},
+		{name: "only limit below granularity", limit: 100, capacity: 100},
+		{name: "required exceeds limit", required: 2 * gib, limit: gib, expectError: true},
+		{name: "negative required", required: -1, expectError: true},
+		{name: "negative limit", limit: -1, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capacityRange := &csi.CapacityRange{RequiredBytes: tt.required, LimitBytes: tt.limit}
+			capacity, err := getCapacity(capacityRange, 4096)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("Expected error, got capacity %d", capacity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if capacity != tt.capacity {
+				t.Errorf("Expected capacity %d, got %d", tt.capacity, capacity)
+			}
+			if !capacityInRange(capacity, capacityRange) {
+				t.Errorf("Capacity %d does not satisfy range [%d, %d]", capacity, tt.required, tt.limit)
+			}
+		})
+	}
+}
+
+func TestCapacityInRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int64
+		required int64
+		limit    int64
+		expected bool
+	}{
+		{name: "exact", capacity: 4096, required: 4096, expected: true},
+		{name: "larger without limit", capacity: 8192, required: 4096, expected: true},
+		{name: "within limit", capacity: 8192, required: 4096, limit: 8192, expected: true},
+		{name: "too small", capacity: 4096, required: 8192, expected: false},
+		{name: "above limit", capacity: 8192, limit: 4096, expected: false},
+		{name: "unlimited without range", capacity: 0, expected: true},
+		{name: "unlimited with limit", capacity: 0, limit: 4096, expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			capacityRange := &csi.CapacityRange{RequiredBytes: tt.required, LimitBytes: tt.limit}
+			if got := capacityInRange(tt.capacity, capacityRange); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 	"k8s.io/klog/v2"
 )
@@ -21,36 +23,48 @@ func (d *BtrfsDriver) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoR
 func (d *BtrfsDriver) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
 	klog.Infof("GetPluginCapabilities: called with args %+v", req)
 
-	return &csi.GetPluginCapabilitiesResponse{
-		Capabilities: []*csi.PluginCapability{
-			{
-				Type: &csi.PluginCapability_Service_{
-					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
-					},
+	capabilities := []*csi.PluginCapability{
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
 				},
 			},
-			{
+		},
+	}
+	// A node-only plugin must not advertise the controller service or controller-side expansion
+	if d.isControllerService() {
+		capabilities = append(capabilities,
+			&csi.PluginCapability{
 				Type: &csi.PluginCapability_Service_{
 					Service: &csi.PluginCapability_Service{
-						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
 					},
 				},
 			},
-			{
+			&csi.PluginCapability{
 				Type: &csi.PluginCapability_VolumeExpansion_{
 					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
 						Type: csi.PluginCapability_VolumeExpansion_ONLINE,
 					},
 				},
 			},
-		},
+		)
+	}
+
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: capabilities,
 	}, nil
 }
 
 func (d *BtrfsDriver) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	klog.Infof("Probe: called with args %+v", req)
 
+	if err := d.checkReadiness(); err != nil {
+		klog.Warningf("Probe: driver is not ready: %v", err)
+		return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+
 	return &csi.ProbeResponse{
 		Ready: wrapperspb.Bool(true),
 	}, nil
@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"path/filepath"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// VolumeLocks keeps track of the volumes and snapshots with an operation in progress.
+// The gRPC server handles requests concurrently, so without it e.g. a DeleteVolume
+// could remove a subvolume while a NodePublishVolume is mounting it.
+type VolumeLocks struct {
+	mutex sync.Mutex
+	locks map[string]struct{}
+}
+
+// NewVolumeLocks creates an empty set of volume locks
+func NewVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{
+		locks: map[string]struct{}{},
+	}
+}
+
+// TryAcquire locks all given IDs (volume IDs, snapshot IDs or names).
+// It returns false without locking anything if an operation on any of the IDs is already in progress.
+func (l *VolumeLocks) TryAcquire(ids ...string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, id := range ids {
+		if _, locked := l.locks[id]; locked {
+			return false
+		}
+	}
+	for _, id := range ids {
+		l.locks[id] = struct{}{}
+	}
+	return true
+}
+
+// Release unlocks all given IDs
+func (l *VolumeLocks) Release(ids ...string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, id := range ids {
+		delete(l.locks, id)
+	}
+}
+
+// lockVolumes acquires the locks for an operation on the given existing volumes or snapshots.
+// Each of them is locked by its ID and by its name, which is the base name of its subvolume.
+// CreateVolume and CreateSnapshot lock the name before the ID is known, and the CO may use
+// an older form of the ID for the same volume, so the name makes these operations exclude each other.
+// The returned function releases the locks again.
+func (d *BtrfsDriver) lockVolumes(ids ...string) (func(), error) {
+	return d.lockNewVolume("", ids...)
+}
+
+// lockNewVolume acquires the locks for creating a volume or snapshot with the given name
+// from the given existing volumes or snapshots (see lockVolumes).
+// The returned function releases the locks again.
+func (d *BtrfsDriver) lockNewVolume(name string, sourceIDs ...string) (func(), error) {
+	// Optional IDs (e.g. a missing content source) are not locked
+	lockIDs := make([]string, 0, 1+2*len(sourceIDs))
+	if name != "" {
+		lockIDs = append(lockIDs, name)
+	}
+	for _, id := range sourceIDs {
+		if id == "" {
+			continue
+		}
+		lockIDs = append(lockIDs, id)
+		// Volumes that cannot be resolved (e.g. because they were deleted) are only locked by their ID
+		if subvolumePath, err := d.resolveVolumeID(id); err == nil {
+			lockIDs = append(lockIDs, filepath.Base(subvolumePath))
+		}
+	}
+
+	if !d.volumeLocks.TryAcquire(lockIDs...) {
+		return nil, status.Errorf(codes.Aborted, "an operation on %v is already in progress", lockIDs)
+	}
+	return func() { d.volumeLocks.Release(lockIDs...) }, nil
+}
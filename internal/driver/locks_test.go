@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	locks := NewVolumeLocks()
+
+	if !locks.TryAcquire("vol-1") {
+		t.Fatal("Expected to acquire lock of vol-1")
+	}
+	if locks.TryAcquire("vol-1") {
+		t.Error("Expected lock of vol-1 to be held")
+	}
+
+	// Locking multiple IDs is all-or-nothing
+	if locks.TryAcquire("vol-2", "vol-1") {
+		t.Error("Expected lock of vol-1 to be held")
+	}
+	if !locks.TryAcquire("vol-2") {
+		t.Error("Expected lock of vol-2 to be released after failed acquisition")
+	}
+
+	locks.Release("vol-1", "vol-2")
+	if !locks.TryAcquire("vol-1", "vol-2") {
+		t.Error("Expected to acquire locks after release")
+	}
+}
+
+// TestLockVolumeName verifies that an existing volume is locked by its name, so that operations
+// on it exclude the creation of a volume with the same name and its use as content source
+func TestLockVolumeName(t *testing.T) {
+	d := &BtrfsDriver{subvolumeRoots: []string{"/var/lib/btrfs-csi"}, volumeLocks: NewVolumeLocks()}
+
+	unlock, err := d.lockVolumes("/var/lib/btrfs-csi/pvc-1")
+	if err != nil {
+		t.Fatalf("Failed to lock volume: %v", err)
+	}
+	if _, err := d.lockNewVolume("pvc-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("Expected Aborted when creating a locked volume, got: %v", err)
+	}
+	if _, err := d.lockNewVolume("snapshot-1", "/var/lib/btrfs-csi/pvc-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("Expected Aborted when using a locked volume as source, got: %v", err)
+	}
+	unlock()
+
+	unlock, err = d.lockNewVolume("pvc-2", "/var/lib/btrfs-csi/snapshot-1", "")
+	if err != nil {
+		t.Fatalf("Failed to lock new volume: %v", err)
+	}
+	if unlockOther, err := d.lockVolumes("/var/lib/btrfs-csi/pvc-1"); err != nil {
+		t.Errorf("Expected other volumes to stay unlocked, got: %v", err)
+	} else {
+		unlockOther()
+	}
+	if _, err := d.lockVolumes("/var/lib/btrfs-csi/snapshot-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("Expected Aborted for the locked content source, got: %v", err)
+	}
+	unlock()
+}
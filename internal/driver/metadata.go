@@ -0,0 +1,240 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// metadataDirName is the directory inside each subvolume root that holds the metadata records.
+	// It is a plain directory, so it is never mistaken for a volume or snapshot subvolume.
+	metadataDirName = ".btrfs-csi"
+	metadataVersion = 1
+
+	metadataTypeVolume   = "volume"
+	metadataTypeSnapshot = "snapshot"
+)
+
+// VolumeMetadata is the persistent record the driver keeps for each volume and snapshot,
+// so that it can answer requests without asking Kubernetes
+type VolumeMetadata struct {
+	Version          int               `json:"version"`
+	ID               string            `json:"id,omitempty"`       // empty for volumes created before structured volume IDs
+	LegacyID         string            `json:"legacyId,omitempty"` // path ID the CO may still use for a volume that got a structured ID later
+	Type             string            `json:"type"`
+	Name             string            `json:"name"`
+	CapacityBytes    int64             `json:"capacityBytes,omitempty"`
+	Parameters       map[string]string `json:"parameters,omitempty"`
+	TargetNode       string            `json:"targetNode,omitempty"`
+	SourceSnapshotID string            `json:"sourceSnapshotId,omitempty"`
+	SourceVolumeID   string            `json:"sourceVolumeId,omitempty"`
+	QuotaMode        QuotaMode         `json:"quotaMode,omitempty"`    // empty for volumes created before quota modes
+	Block            bool              `json:"block,omitempty"`        // raw block volume backed by an image file
+	Preallocated     bool              `json:"preallocated,omitempty"` // the image of a raw block volume is fully allocated
+	NoDataCOW        bool              `json:"nodatacow,omitempty"`    // copy-on-write is disabled for the data of the volume
+	NoDataSum        bool              `json:"nodatasum,omitempty"`    // checksums are disabled for the data of the volume
+	Compression      string            `json:"compression,omitempty"`  // compression property of the volume, e.g. "zstd"
+	CreationTime     time.Time         `json:"creationTime"`
+}
+
+// GetQuotaMode returns the quota mode of the volume (referenced for volumes without metadata or quota mode)
+func (m *VolumeMetadata) GetQuotaMode() QuotaMode {
+	if m == nil || m.QuotaMode == "" {
+		return QuotaModeReferenced
+	}
+	return m.QuotaMode
+}
+
+// IsCompressed returns whether a compression algorithm was set for the volume
+func (m *VolumeMetadata) IsCompressed() bool {
+	return m != nil && m.Compression != "" && m.Compression != "none"
+}
+
+// ContentSource returns the CSI content source the volume was created from (nil for empty volumes)
+func (m *VolumeMetadata) ContentSource() *csi.VolumeContentSource {
+	switch {
+	case m.SourceSnapshotID != "":
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: m.SourceSnapshotID},
+			},
+		}
+	case m.SourceVolumeID != "" && m.Type == metadataTypeVolume:
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: m.SourceVolumeID},
+			},
+		}
+	default:
+		return nil
+	}
+}
+
+// metadataPath returns the path of the metadata record of the given subvolume
+func metadataPath(subvolumePath string) string {
+	return filepath.Join(filepath.Dir(subvolumePath), metadataDirName, filepath.Base(subvolumePath)+".json")
+}
+
+// readVolumeMetadata returns the metadata record of the given subvolume
+// (nil if the subvolume has none, e.g. because it was created by an older version of the driver)
+func (d *BtrfsDriver) readVolumeMetadata(subvolumePath string) (*VolumeMetadata, error) {
+	return readMetadataFile(hostPath(metadataPath(subvolumePath)))
+}
+
+// writeVolumeMetadata atomically creates or replaces the metadata record of the given subvolume
+func (d *BtrfsDriver) writeVolumeMetadata(subvolumePath string, metadata *VolumeMetadata) error {
+	return writeMetadataFile(hostPath(metadataPath(subvolumePath)), metadata)
+}
+
+// deleteVolumeMetadata removes the metadata record of the given subvolume
+func (d *BtrfsDriver) deleteVolumeMetadata(subvolumePath string) error {
+	if err := os.Remove(hostPath(metadataPath(subvolumePath))); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete metadata of %s: %v", subvolumePath, err)
+	}
+	return nil
+}
+
+// hasMetadataType returns whether the subvolume has a metadata record of the given type,
+// i.e. whether it is a volume or snapshot of the driver
+func (d *BtrfsDriver) hasMetadataType(subvolumePath, metadataType string) bool {
+	metadata, err := d.readVolumeMetadata(subvolumePath)
+	if err != nil {
+		klog.Warningf("Unable to read metadata of %s: %v", subvolumePath, err)
+		return false
+	}
+	return metadata != nil && metadata.Type == metadataType
+}
+
+// findMetadataByID returns the path of the subvolume whose metadata record has the given ID,
+// or an empty string if there is none. The subvolume itself may no longer exist.
+func (d *BtrfsDriver) findMetadataByID(volumeID string) string {
+	for _, root := range d.getSubvolumeRoots() {
+		entries, err := os.ReadDir(hostPath(filepath.Join(root, metadataDirName)))
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name, ok := strings.CutSuffix(entry.Name(), ".json")
+			if !ok || entry.IsDir() {
+				continue
+			}
+			subvolumePath := filepath.Join(root, name)
+			if metadata, err := d.readVolumeMetadata(subvolumePath); err == nil && metadata != nil && metadata.ID == volumeID {
+				return subvolumePath
+			}
+		}
+	}
+	return ""
+}
+
+// adoptLegacyVolumes records all subvolumes in the subvolume roots that have no metadata,
+// so that volumes and snapshots created before the metadata store was introduced remain usable by their path ID.
+// Subvolumes without metadata are otherwise rejected, because they may not have been created by the driver.
+func (d *BtrfsDriver) adoptLegacyVolumes() {
+	for _, root := range d.getSubvolumeRoots() {
+		subvolumes, err := d.listSubvolumes(root)
+		if err != nil {
+			klog.Warningf("Failed to list legacy volumes in %s: %v", root, err)
+			continue
+		}
+		for _, subvolume := range subvolumes {
+			if metadata, err := d.readVolumeMetadata(subvolume.Path); err != nil || metadata != nil {
+				continue
+			}
+			if _, err := d.adoptLegacySubvolume(subvolume); err != nil {
+				klog.Warningf("Failed to adopt legacy subvolume %s: %v", subvolume.Path, err)
+			}
+		}
+	}
+}
+
+// adoptLegacySubvolume records a subvolume without metadata as a volume or snapshot with a path ID
+func (d *BtrfsDriver) adoptLegacySubvolume(subvolume SubvolumeInfo) (*VolumeMetadata, error) {
+	// Snapshots are the only read-only subvolumes created by the driver
+	metadata := &VolumeMetadata{
+		Type:         metadataTypeVolume,
+		Name:         filepath.Base(subvolume.Path),
+		TargetNode:   d.nodeID,
+		CreationTime: subvolume.CreationTime,
+	}
+	if subvolume.ReadOnly {
+		metadata.Type = metadataTypeSnapshot
+	} else {
+		metadata.CapacityBytes = d.getAppliedCapacity(subvolume.Path, QuotaModeReferenced, 0)
+	}
+	if err := d.writeVolumeMetadata(subvolume.Path, metadata); err != nil {
+		return nil, err
+	}
+	klog.Infof("Adopted legacy %s %s", metadata.Type, subvolume.Path)
+	return metadata, nil
+}
+
+func readMetadataFile(path string) (*VolumeMetadata, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read metadata file %s: %v", path, err)
+	}
+
+	metadata := &VolumeMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata file %s: %v", path, err)
+	}
+	if metadata.Version > metadataVersion {
+		return nil, fmt.Errorf("metadata file %s has unsupported version %d", path, metadata.Version)
+	}
+	return metadata, nil
+}
+
+// writeMetadataFile writes the metadata to a temporary file and renames it into place,
+// so that readers either see the old or the new record, but never a partial one
+func writeMetadataFile(path string, metadata *VolumeMetadata) error {
+	metadata.Version = metadataVersion
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %v", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create metadata directory %s: %v", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create metadata file in %s: %v", dir, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metadata file %s: %v", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync metadata file %s: %v", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close metadata file %s: %v", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename metadata file to %s: %v", path, err)
+	}
+
+	// Persist the rename itself
+	if f, err := os.Open(dir); err == nil {
+		f.Sync()
+		f.Close()
+	}
+	return nil
+}
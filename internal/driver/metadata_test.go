@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), metadataDirName, "pvc-1.json")
+
+	metadata, err := readMetadataFile(path)
+	if err != nil {
+		t.Fatalf("readMetadataFile failed: %v", err)
+	}
+	if metadata != nil {
+		t.Fatalf("Expected no metadata, got %+v", metadata)
+	}
+
+	written := &VolumeMetadata{
+		Type:             metadataTypeVolume,
+		Name:             "pvc-1",
+		CapacityBytes:    1024 * 1024,
+		Parameters:       map[string]string{"subvolumeRoot": "/var/lib/btrfs-csi"},
+		TargetNode:       "node-1",
+		SourceSnapshotID: "/var/lib/btrfs-csi/snapshot-1",
+		CreationTime:     time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := writeMetadataFile(path, written); err != nil {
+		t.Fatalf("writeMetadataFile failed: %v", err)
+	}
+
+	metadata, err = readMetadataFile(path)
+	if err != nil {
+		t.Fatalf("readMetadataFile failed: %v", err)
+	}
+	if metadata.Version != metadataVersion || metadata.Name != written.Name || metadata.CapacityBytes != written.CapacityBytes ||
+		metadata.Parameters["subvolumeRoot"] != "/var/lib/btrfs-csi" || !metadata.CreationTime.Equal(written.CreationTime) {
+		t.Errorf("Expected %+v, got %+v", written, metadata)
+	}
+	if id := metadata.ContentSource().GetSnapshot().GetSnapshotId(); id != written.SourceSnapshotID {
+		t.Errorf("Expected content source snapshot %s, got %s", written.SourceSnapshotID, id)
+	}
+
+	// Replacing a record must not leave temporary files behind
+	written.CapacityBytes *= 2
+	if err := writeMetadataFile(path, written); err != nil {
+		t.Fatalf("writeMetadataFile failed: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 file in metadata directory, got %d", len(entries))
+	}
+	metadata, err = readMetadataFile(path)
+	if err != nil {
+		t.Fatalf("readMetadataFile failed: %v", err)
+	}
+	if metadata.CapacityBytes != written.CapacityBytes {
+		t.Errorf("Expected capacity %d, got %d", written.CapacityBytes, metadata.CapacityBytes)
+	}
+}
+
+func TestMetadataFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	corrupt := filepath.Join(dir, "corrupt.json")
+	if err := os.WriteFile(corrupt, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMetadataFile(corrupt); err == nil {
+		t.Error("Expected error for corrupt metadata file")
+	}
+
+	future := filepath.Join(dir, "future.json")
+	if err := os.WriteFile(future, []byte(`{"version": 99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMetadataFile(future); err == nil {
+		t.Error("Expected error for unsupported metadata version")
+	}
+}
+
+func TestMetadataContentSource(t *testing.T) {
+	snapshotID := "v2:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:257"
+
+	metadata := &VolumeMetadata{Type: metadataTypeVolume, SourceSnapshotID: snapshotID}
+	if id := metadata.ContentSource().GetSnapshot().GetSnapshotId(); id != snapshotID {
+		t.Errorf("Expected content source snapshot %s, got %s", snapshotID, id)
+	}
+
+	volumeID := "v2:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:256"
+	metadata = &VolumeMetadata{Type: metadataTypeVolume, SourceVolumeID: volumeID}
+	if id := metadata.ContentSource().GetVolume().GetVolumeId(); id != volumeID {
+		t.Errorf("Expected content source volume %s, got %s", volumeID, id)
+	}
+
+	// Snapshots record their source volume, but were not created from a content source
+	metadata = &VolumeMetadata{Type: metadataTypeSnapshot, SourceVolumeID: volumeID}
+	if source := metadata.ContentSource(); source != nil {
+		t.Errorf("Expected no content source for a snapshot, got %+v", source)
+	}
+
+	metadata = &VolumeMetadata{Type: metadataTypeVolume}
+	if source := metadata.ContentSource(); source != nil {
+		t.Errorf("Expected no content source for an empty volume, got %+v", source)
+	}
+}
+
+func TestMetadataQuotaMode(t *testing.T) {
+	var metadata *VolumeMetadata
+	if mode := metadata.GetQuotaMode(); mode != QuotaModeReferenced {
+		t.Errorf("Expected %s for a volume without metadata, got %s", QuotaModeReferenced, mode)
+	}
+	if mode := (&VolumeMetadata{}).GetQuotaMode(); mode != QuotaModeReferenced {
+		t.Errorf("Expected %s for a volume without quota mode, got %s", QuotaModeReferenced, mode)
+	}
+	if mode := (&VolumeMetadata{QuotaMode: QuotaModeExclusive}).GetQuotaMode(); mode != QuotaModeExclusive {
+		t.Errorf("Expected %s, got %s", QuotaModeExclusive, mode)
+	}
+}
@@ -0,0 +1,232 @@
+package driver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	metricsNamespace = "btrfs_csi"
+
+	// Parameters added to CreateVolume requests by the external-provisioner with --extra-create-metadata
+	pvcNameParameter      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceParameter = "csi.storage.k8s.io/pvc/namespace"
+)
+
+var (
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of CSI RPCs in seconds.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60},
+	}, []string{"method"})
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_errors_total",
+		Help:      "Number of CSI RPCs that returned an error, by gRPC status code.",
+	}, []string{"method", "code"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of Btrfs and loop device operations performed through ioctls in seconds.",
+		Buckets:   []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30},
+	}, []string{"operation"})
+	operationFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_failures_total",
+		Help:      "Number of Btrfs and loop device operations performed through ioctls that failed.",
+	}, []string{"operation"})
+
+	filesystemSizeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "filesystem", "size_bytes"),
+		"Size of all devices of the Btrfs filesystem in bytes.",
+		[]string{"filesystem_uuid", "path"}, nil)
+	filesystemAllocatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "filesystem", "allocated_bytes"),
+		"Bytes allocated to chunks on the devices of the Btrfs filesystem.",
+		[]string{"filesystem_uuid", "path"}, nil)
+	filesystemUsedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "filesystem", "used_bytes"),
+		"Bytes used by data and metadata of the Btrfs filesystem.",
+		[]string{"filesystem_uuid", "path"}, nil)
+	filesystemFreeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "filesystem", "free_bytes"),
+		"Estimated free bytes of the Btrfs filesystem.",
+		[]string{"filesystem_uuid", "path"}, nil)
+	filesystemQuotaDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "filesystem", "quota_accounting_info"),
+		"Quota accounting in use on the Btrfs filesystem (none, qgroup or simple).",
+		[]string{"filesystem_uuid", "path", "accounting"}, nil)
+
+	volumeReferencedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "referenced_bytes"),
+		"Bytes referenced by the qgroup of the volume.",
+		[]string{"volume_id", "namespace", "persistentvolumeclaim"}, nil)
+	volumeExclusiveDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "exclusive_bytes"),
+		"Bytes exclusively used by the qgroup of the volume.",
+		[]string{"volume_id", "namespace", "persistentvolumeclaim"}, nil)
+	volumeLimitDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "limit_bytes"),
+		"Limit of the referenced or exclusive bytes of the volume, depending on its quota mode (0 if unlimited).",
+		[]string{"volume_id", "namespace", "persistentvolumeclaim"}, nil)
+	volumeDataDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "data_bytes"),
+		"Bytes of file data of a compressed volume before compression.",
+		[]string{"volume_id", "namespace", "persistentvolumeclaim"}, nil)
+	volumeDataDiskDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "data_disk_bytes"),
+		"Bytes the file data of a compressed volume takes up on disk.",
+		[]string{"volume_id", "namespace", "persistentvolumeclaim"}, nil)
+	volumeCompressionRatioDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "compression_ratio"),
+		"Bytes on disk per byte of file data of a compressed volume (lower is better).",
+		[]string{"volume_id", "namespace", "persistentvolumeclaim"}, nil)
+)
+
+// observeGRPC is a gRPC interceptor that records the duration and errors of RPCs
+func observeGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(method, status.Code(err).String()).Inc()
+	}
+	return resp, err
+}
+
+// observeOperation records the duration and result of a Btrfs or loop device operation performed through ioctls,
+// e.g. "subvolume create"
+func observeOperation(operation string, start time.Time, err error) {
+	operationDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		operationFailures.WithLabelValues(operation).Inc()
+	}
+}
+
+// metricsCollector collects the filesystem and volume usage metrics when the metrics are scraped
+type metricsCollector struct {
+	driver *BtrfsDriver
+}
+
+func (c *metricsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- filesystemSizeDesc
+	ch <- filesystemAllocatedDesc
+	ch <- filesystemUsedDesc
+	ch <- filesystemFreeDesc
+	ch <- filesystemQuotaDesc
+	ch <- volumeReferencedDesc
+	ch <- volumeExclusiveDesc
+	ch <- volumeLimitDesc
+	ch <- volumeDataDesc
+	ch <- volumeDataDiskDesc
+	ch <- volumeCompressionRatioDesc
+}
+
+func (c *metricsCollector) Collect(ch chan<- prometheus.Metric) {
+	c.collectFilesystems(ch)
+	c.collectVolumes(ch)
+}
+
+// collectFilesystems reports the usage of each filesystem the subvolume roots are located on
+func (c *metricsCollector) collectFilesystems(ch chan<- prometheus.Metric) {
+	seen := map[string]bool{}
+	for _, root := range c.driver.getSubvolumeRoots() {
+		uuid, err := c.driver.getFilesystemUUID(root)
+		if err != nil {
+			klog.Warningf("Unable to collect metrics of subvolume root %s: %v", root, err)
+			continue
+		}
+		if seen[uuid] {
+			continue
+		}
+		seen[uuid] = true
+
+		usage, err := c.driver.getBtrfsFilesystemUsage(root)
+		if err != nil {
+			klog.Warningf("Unable to collect metrics of subvolume root %s: %v", root, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(filesystemSizeDesc, prometheus.GaugeValue, float64(usage.DeviceSize), uuid, root)
+		ch <- prometheus.MustNewConstMetric(filesystemAllocatedDesc, prometheus.GaugeValue, float64(usage.DeviceAllocated), uuid, root)
+		ch <- prometheus.MustNewConstMetric(filesystemUsedDesc, prometheus.GaugeValue, float64(usage.Used), uuid, root)
+		ch <- prometheus.MustNewConstMetric(filesystemFreeDesc, prometheus.GaugeValue, float64(usage.FreeEstimated), uuid, root)
+
+		if accounting, err := c.driver.getQuotaAccounting(root); err == nil {
+			ch <- prometheus.MustNewConstMetric(filesystemQuotaDesc, prometheus.GaugeValue, 1, uuid, root, string(accounting))
+		} else {
+			klog.Warningf("Unable to get quota accounting of subvolume root %s: %v", root, err)
+		}
+	}
+}
+
+// collectVolumes reports the qgroup usage and limit of each volume,
+// and the compression of volumes with a compression parameter
+func (c *metricsCollector) collectVolumes(ch chan<- prometheus.Metric) {
+	subvolumes, volumeIDs, err := c.driver.findVolumes()
+	if err != nil {
+		klog.Warningf("Unable to collect volume metrics: %v", err)
+		return
+	}
+
+	for i, subvolume := range subvolumes {
+		qgroup, err := c.driver.getSubvolumeQgroup(subvolume.Path)
+		if err != nil {
+			klog.V(4).Infof("Unable to collect metrics of volume %s: %v", subvolume.Path, err)
+			continue
+		}
+
+		var namespace, pvc string
+		metadata, err := c.driver.readVolumeMetadata(subvolume.Path)
+		if err == nil && metadata != nil {
+			namespace = metadata.Parameters[pvcNamespaceParameter]
+			pvc = metadata.Parameters[pvcNameParameter]
+		}
+		_, limit := qgroupUsage(qgroup, metadata.GetQuotaMode())
+
+		labels := []string{volumeIDs[i], namespace, pvc}
+		ch <- prometheus.MustNewConstMetric(volumeReferencedDesc, prometheus.GaugeValue, float64(qgroup.Referenced), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeExclusiveDesc, prometheus.GaugeValue, float64(qgroup.Exclusive), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeLimitDesc, prometheus.GaugeValue, float64(limit), labels...)
+
+		// Computing the compression requires reading all file extents of the volume, only do it where it matters
+		if !metadata.IsCompressed() {
+			continue
+		}
+		stats, err := c.driver.getCompressionStats(subvolume.Path)
+		if err != nil {
+			klog.V(4).Infof("Unable to collect compression metrics of volume %s: %v", subvolume.Path, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(volumeDataDesc, prometheus.GaugeValue, float64(stats.UncompressedBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeDataDiskDesc, prometheus.GaugeValue, float64(stats.DiskBytes), labels...)
+		ch <- prometheus.MustNewConstMetric(volumeCompressionRatioDesc, prometheus.GaugeValue, stats.Ratio(), labels...)
+	}
+}
+
+// newMetricsHandler returns the HTTP handler that exposes the metrics of the driver in the Prometheus format
+func (d *BtrfsDriver) newMetricsHandler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		rpcDuration,
+		rpcErrors,
+		operationDuration,
+		operationFailures,
+		&metricsCollector{driver: d},
+	)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,471 @@
+package driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+// mountInfoPath is the file listing all mounts visible to the driver
+const mountInfoPath = "/proc/self/mountinfo"
+
+// MountInfo contains information about a single mount from /proc/self/mountinfo
+type MountInfo struct {
+	MountID        int
+	ParentID       int
+	Root           string   // Root of the mount within the filesystem
+	MountPoint     string   // Mount point relative to the process's root
+	Options        []string // Per-mount options, e.g. "rw" or "noatime"
+	OptionalFields []string // Propagation fields, e.g. "shared:1" or "master:2"
+	FSType         string
+	Source         string
+	SuperOptions   []string // Per-superblock options
+}
+
+// IsShared returns true if the mount is part of a shared peer group,
+// i.e. mount events below it are propagated to its peers
+func (m MountInfo) IsShared() bool {
+	for _, field := range m.OptionalFields {
+		if strings.HasPrefix(field, "shared:") {
+			return true
+		}
+	}
+	return false
+}
+
+// HasOption returns true if the mount has the given per-mount option
+func (m MountInfo) HasOption(option string) bool {
+	for _, o := range m.Options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// mountFlags are the per-mount flags that can be requested in the mount flags of a volume capability.
+// They only apply to the bind mount of the volume.
+var mountFlags = map[string]uintptr{
+	"ro":          unix.MS_RDONLY,
+	"noatime":     unix.MS_NOATIME,
+	"nodiratime":  unix.MS_NODIRATIME,
+	"relatime":    unix.MS_RELATIME,
+	"strictatime": unix.MS_STRICTATIME,
+	"nodev":       unix.MS_NODEV,
+	"nosuid":      unix.MS_NOSUID,
+	"noexec":      unix.MS_NOEXEC,
+}
+
+// defaultCommitInterval is the commit interval in seconds Btrfs uses without commit mount option
+const defaultCommitInterval = "30"
+
+// btrfsMountOptions are the Btrfs mount options that can be requested in the mount flags of a volume capability,
+// mapped to a function validating their value (nil for options without a value).
+// These options belong to the filesystem and would apply to all of its subvolumes,
+// so they are only accepted if the filesystem is already mounted with them.
+// Compression is not among them, it is set per volume with the compression StorageClass parameter.
+var btrfsMountOptions = map[string]func(string) error{
+	"autodefrag":      nil,
+	"noautodefrag":    nil,
+	"commit":          validateCommitInterval,
+	"discard":         validateDiscard,
+	"nodiscard":       nil,
+	"flushoncommit":   nil,
+	"noflushoncommit": nil,
+}
+
+// mountOptions are the parsed mount flags of a volume capability
+type mountOptions struct {
+	// flags are the per-mount flags, applied by remounting the bind mount
+	flags uintptr
+	// filesystemOptions are the Btrfs mount options of the filesystem, which must already be in effect
+	filesystemOptions []string
+}
+
+// matches returns whether an existing mount has the per-mount flags of the options,
+// i.e. it is read-only if and only if the options are read-only and has all other requested flags
+func (o mountOptions) matches(mount MountInfo) bool {
+	if mount.HasOption("ro") != (o.flags&unix.MS_RDONLY != 0) {
+		return false
+	}
+	for name, flag := range mountFlags {
+		// strictatime is the absence of the other atime options, it is not listed itself
+		if name == "ro" || name == "strictatime" || o.flags&flag == 0 {
+			continue
+		}
+		if !mount.HasOption(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMountFlags validates the mount flags of a volume capability against the supported mount flags and options
+func parseMountFlags(flags []string) (mountOptions, error) {
+	options := mountOptions{}
+	for _, flag := range flags {
+		// Kubernetes passes the mountOptions of a StorageClass or PV, which may contain comma separated lists
+		for _, option := range strings.Split(flag, ",") {
+			option = strings.TrimSpace(option)
+			if option == "" {
+				continue
+			}
+			if value, ok := mountFlags[option]; ok {
+				options.flags |= value
+				continue
+			}
+
+			name, value, hasValue := strings.Cut(option, "=")
+			if name == "compress" || name == "compress-force" {
+				return options, fmt.Errorf("mount option %q is not supported, use the %s StorageClass parameter instead", name, compressionParameter)
+			}
+			validate, ok := btrfsMountOptions[name]
+			if !ok {
+				return options, fmt.Errorf("unsupported mount option %q", option)
+			}
+			if hasValue && validate == nil {
+				return options, fmt.Errorf("mount option %q does not take a value", name)
+			}
+			if hasValue {
+				if err := validate(value); err != nil {
+					return options, fmt.Errorf("invalid mount option %q: %v", option, err)
+				}
+			}
+			options.filesystemOptions = append(options.filesystemOptions, option)
+		}
+	}
+	return options, nil
+}
+
+// hasFilesystemOption returns whether the Btrfs mount option is in effect on a filesystem with the given superblock options.
+// Options that are in effect by default are not listed by the kernel.
+func hasFilesystemOption(superOptions []string, option string) bool {
+	name, value, _ := strings.Cut(option, "=")
+	hasOption := func(name string) bool {
+		return slices.ContainsFunc(superOptions, func(o string) bool {
+			n, _, _ := strings.Cut(o, "=")
+			return n == name
+		})
+	}
+
+	if enabled, ok := strings.CutPrefix(name, "no"); ok {
+		if _, ok := btrfsMountOptions[enabled]; ok {
+			return !hasOption(enabled)
+		}
+	}
+	switch {
+	case name == "commit" && value == defaultCommitInterval && !hasOption("commit"):
+		return true
+	case name == "discard" && (value == "" || value == "sync"):
+		return slices.Contains(superOptions, "discard") || slices.Contains(superOptions, "discard=sync")
+	}
+	return slices.Contains(superOptions, option)
+}
+
+// checkFilesystemOptions verifies that the Btrfs mount options of the filesystem the subvolume is located on
+// are in effect. They are never changed by the driver, since they would apply to all subvolumes of the filesystem.
+func checkFilesystemOptions(subvolumePath string, options mountOptions) error {
+	if len(options.filesystemOptions) == 0 {
+		return nil
+	}
+
+	mount, err := findParentMount(hostPath(subvolumePath))
+	if err != nil {
+		return fmt.Errorf("failed to find mount of %s: %v", subvolumePath, err)
+	}
+	missing := []string{}
+	for _, option := range options.filesystemOptions {
+		if !hasFilesystemOption(mount.SuperOptions, option) {
+			missing = append(missing, option)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the filesystem of %s is not mounted with the options %v, which apply to all of its subvolumes and must be set when mounting it on the host",
+			subvolumePath, missing)
+	}
+	return nil
+}
+
+// validateCommitInterval validates the value of the commit mount option (in seconds)
+func validateCommitInterval(value string) error {
+	if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+		return fmt.Errorf("commit interval must be a positive number of seconds")
+	}
+	return nil
+}
+
+// validateDiscard validates the value of the discard mount option
+func validateDiscard(value string) error {
+	if value != "sync" && value != "async" {
+		return fmt.Errorf("discard mode must be sync or async")
+	}
+	return nil
+}
+
+// mountSubvolume bind mounts a Btrfs subvolume to the target path on the host.
+// The per-mount flags of the options are applied by remounting the bind mount.
+func (d *BtrfsDriver) mountSubvolume(subvolumePath, targetPath string, options mountOptions) error {
+	if err := bindMount(hostPath(subvolumePath), targetPath, options); err != nil {
+		return err
+	}
+
+	klog.Infof("Mounted subvolume %s to %s", subvolumePath, targetPath)
+	return nil
+}
+
+// bindMount bind mounts the source (a path in the container) to the target path on the host
+// and applies the per-mount flags of the options
+func bindMount(source, targetPath string, options mountOptions) error {
+	target := hostPath(targetPath)
+
+	// The mount is created inside the container's mount namespace,
+	// it only becomes visible on the host if it is propagated there
+	parent, err := findParentMount(target)
+	if err != nil {
+		return fmt.Errorf("failed to find parent mount of %s: %v", targetPath, err)
+	}
+	if !parent.IsShared() {
+		return fmt.Errorf("mount %s is not shared, ensure the host filesystem is mounted with bidirectional mount propagation", parent.MountPoint)
+	}
+
+	if err := unix.Mount(source, target, "", unix.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s: %v", source, err)
+	}
+
+	// Bind mounts ignore all flags except MS_REC when they are created,
+	// therefore any additional flags need to be applied with a remount
+	if options.flags == 0 {
+		return nil
+	}
+	if err := remountBind(target, options.flags); err != nil {
+		if unmountErr := unix.Unmount(target, 0); unmountErr != nil {
+			klog.Errorf("Failed to unmount %s after failed remount: %v", targetPath, unmountErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// remountBind changes the flags of an existing bind mount
+func remountBind(target string, flags uintptr) error {
+	if err := unix.Mount("", target, "", unix.MS_REMOUNT|unix.MS_BIND|flags, ""); err != nil {
+		return fmt.Errorf("failed to remount %s: %v", target, err)
+	}
+	return nil
+}
+
+// unmountVolume unmounts a volume from the target path on the host
+func (d *BtrfsDriver) unmountVolume(targetPath string) error {
+	target := hostPath(targetPath)
+
+	mount, err := findMount(target)
+	if err != nil {
+		return fmt.Errorf("failed to check mount of %s: %v", targetPath, err)
+	}
+	if mount == nil {
+		klog.Infof("Volume is not mounted at %s, skipping unmount", targetPath)
+		return nil
+	}
+
+	if err := unix.Unmount(target, 0); err != nil && !errors.Is(err, unix.EINVAL) {
+		return fmt.Errorf("failed to unmount volume: %v", err)
+	}
+
+	klog.Infof("Unmounted volume from %s", targetPath)
+	return nil
+}
+
+// isSameSubvolume checks if the target path shows the same directory as the subvolume,
+// i.e. the subvolume is mounted at the target path
+func isSameSubvolume(subvolumePath, targetPath string) (bool, error) {
+	subvolume, err := os.Stat(hostPath(subvolumePath))
+	if err != nil {
+		return false, err
+	}
+	target, err := os.Stat(hostPath(targetPath))
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(subvolume, target), nil
+}
+
+// isSubvolumePublished checks if the subvolume is bind mounted anywhere on the node
+func isSubvolumePublished(subvolumePath string) (bool, error) {
+	mounts, err := getMountInfo()
+	if err != nil {
+		return false, err
+	}
+
+	subvolume, err := os.Stat(hostPath(subvolumePath))
+	if err != nil {
+		return false, err
+	}
+
+	for _, mount := range mounts {
+		// The root of a bind mount of the subvolume is the subvolume's path within the filesystem
+		if mount.FSType != "btrfs" || filepath.Base(mount.Root) != filepath.Base(subvolumePath) {
+			continue
+		}
+		target, err := os.Stat(mount.MountPoint)
+		if err != nil {
+			continue
+		}
+		if os.SameFile(subvolume, target) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isDeviceMounted checks if the given device node (e.g. /dev/loop0) is bind mounted anywhere on the node
+func isDeviceMounted(devicePath string) (bool, error) {
+	mounts, err := getMountInfo()
+	if err != nil {
+		return false, err
+	}
+
+	// The root of a bind mount of a device node is its path within devtmpfs
+	root := strings.TrimPrefix(devicePath, "/dev")
+	for _, mount := range mounts {
+		if mount.FSType == "devtmpfs" && mount.Root == root {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// findMount returns the mount with the given mount point (nil if there is none).
+// If the mount point is over-mounted, the topmost mount is returned.
+func findMount(mountPoint string) (*MountInfo, error) {
+	mounts, err := getMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoint = filepath.Clean(mountPoint)
+	var found *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == mountPoint {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+// findParentMount returns the mount which contains the given path
+func findParentMount(path string) (*MountInfo, error) {
+	mounts, err := getMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	path = filepath.Clean(path)
+	var found *MountInfo
+	for i := range mounts {
+		mountPoint := mounts[i].MountPoint
+		if path == mountPoint || mountPoint == "/" || strings.HasPrefix(path, mountPoint+"/") {
+			if found == nil || len(mountPoint) >= len(found.MountPoint) {
+				found = &mounts[i]
+			}
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no mount found for %s", path)
+	}
+	return found, nil
+}
+
+// getMountInfo returns all mounts of the driver's mount namespace
+func getMountInfo() ([]MountInfo, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
+
+// parseMountInfo parses the format of /proc/<pid>/mountinfo, see proc(5)
+func parseMountInfo(r io.Reader) ([]MountInfo, error) {
+	mounts := []MountInfo{}
+
+	// Example line:
+	// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if len(fields) < 7 || separator == -1 || len(fields) < separator+3 {
+			return nil, fmt.Errorf("invalid mountinfo line: %q", scanner.Text())
+		}
+
+		mountID, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse mount ID: %v", err)
+		}
+		parentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parent mount ID: %v", err)
+		}
+
+		mount := MountInfo{
+			MountID:        mountID,
+			ParentID:       parentID,
+			Root:           unescapeMountInfo(fields[3]),
+			MountPoint:     unescapeMountInfo(fields[4]),
+			Options:        strings.Split(fields[5], ","),
+			OptionalFields: fields[6:separator],
+			FSType:         fields[separator+1],
+			Source:         unescapeMountInfo(fields[separator+2]),
+		}
+		if len(fields) > separator+3 {
+			mount.SuperOptions = strings.Split(fields[separator+3], ",")
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mounts, nil
+}
+
+// unescapeMountInfo replaces the octal escape sequences (e.g. "\040" for space) used in mountinfo
+func unescapeMountInfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if value, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,166 @@
+package driver
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	mountInfo := `22 1 0:21 / / rw,relatime shared:1 - btrfs /dev/sda2 rw,ssd,space_cache=v2,subvolid=256,subvol=/@
+36 22 0:21 /@/var/lib/btrfs-csi/pvc-1 /host/var/lib/kubelet/pods/abc/volumes/kubernetes.io~csi/pvc-1/mount rw,nodev shared:1 master:2 - btrfs /dev/sda2 rw,ssd
+37 22 0:44 / /mnt/with\040space ro,nosuid - tmpfs tmpfs rw
+`
+
+	mounts, err := parseMountInfo(strings.NewReader(mountInfo))
+	if err != nil {
+		t.Fatalf("Failed to parse mountinfo: %v", err)
+	}
+	if len(mounts) != 3 {
+		t.Fatalf("Expected 3 mounts, got %d", len(mounts))
+	}
+
+	root := mounts[0]
+	if root.MountID != 22 || root.ParentID != 1 {
+		t.Errorf("Unexpected mount IDs %d/%d", root.MountID, root.ParentID)
+	}
+	if root.MountPoint != "/" || root.FSType != "btrfs" || root.Source != "/dev/sda2" {
+		t.Errorf("Unexpected root mount %+v", root)
+	}
+	if !root.IsShared() {
+		t.Error("Expected root mount to be shared")
+	}
+
+	volume := mounts[1]
+	if volume.Root != "/@/var/lib/btrfs-csi/pvc-1" {
+		t.Errorf("Unexpected mount root %s", volume.Root)
+	}
+	if len(volume.OptionalFields) != 2 {
+		t.Errorf("Expected 2 optional fields, got %v", volume.OptionalFields)
+	}
+	if !volume.HasOption("nodev") || volume.HasOption("ro") {
+		t.Errorf("Unexpected mount options %v", volume.Options)
+	}
+
+	tmpfs := mounts[2]
+	if tmpfs.MountPoint != "/mnt/with space" {
+		t.Errorf("Expected unescaped mount point, got %q", tmpfs.MountPoint)
+	}
+	if tmpfs.IsShared() {
+		t.Error("Expected tmpfs mount to be private")
+	}
+	if !tmpfs.HasOption("ro") {
+		t.Errorf("Expected read-only mount, got options %v", tmpfs.Options)
+	}
+}
+
+func TestParseMountInfoInvalid(t *testing.T) {
+	if _, err := parseMountInfo(strings.NewReader("22 1 0:21 / / rw,relatime shared:1\n")); err == nil {
+		t.Error("Expected error for line without separator")
+	}
+}
+
+func TestParseMountFlags(t *testing.T) {
+	tests := []struct {
+		name              string
+		flags             []string
+		mountFlags        uintptr
+		filesystemOptions []string
+		expectError       bool
+	}{
+		{name: "no flags"},
+		{name: "per-mount flags", flags: []string{"noatime", "nodev", "nosuid", "noexec"},
+			mountFlags: unix.MS_NOATIME | unix.MS_NODEV | unix.MS_NOSUID | unix.MS_NOEXEC},
+		{name: "comma separated", flags: []string{"noatime,autodefrag"}, mountFlags: unix.MS_NOATIME, filesystemOptions: []string{"autodefrag"}},
+		{name: "commit interval", flags: []string{"commit=120"}, filesystemOptions: []string{"commit=120"}},
+		{name: "async discard", flags: []string{"discard=async"}, filesystemOptions: []string{"discard=async"}},
+		{name: "read-only", flags: []string{"ro"}, mountFlags: unix.MS_RDONLY},
+		{name: "unsupported flag", flags: []string{"suid"}, expectError: true},
+		{name: "unsupported btrfs option", flags: []string{"subvol=/other"}, expectError: true},
+		{name: "unexpected value", flags: []string{"autodefrag=1"}, expectError: true},
+		{name: "compression", flags: []string{"compress=zstd:3"}, expectError: true},
+		{name: "default compression", flags: []string{"compress"}, expectError: true},
+		{name: "forced compression", flags: []string{"noatime,compress-force=lzo"}, expectError: true},
+		{name: "invalid commit interval", flags: []string{"commit=0"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := parseMountFlags(tt.flags)
+			if tt.expectError {
+				if err == nil {
+					t.Fatalf("Expected error, got %+v", options)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if options.flags != tt.mountFlags {
+				t.Errorf("Expected mount flags %#x, got %#x", tt.mountFlags, options.flags)
+			}
+			if !slices.Equal(options.filesystemOptions, tt.filesystemOptions) {
+				t.Errorf("Expected filesystem options %v, got %v", tt.filesystemOptions, options.filesystemOptions)
+			}
+		})
+	}
+}
+
+func TestMountOptionsMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		flags    uintptr
+		options  []string
+		expected bool
+	}{
+		{name: "read-write", options: []string{"rw", "relatime"}, expected: true},
+		{name: "read-only", flags: unix.MS_RDONLY, options: []string{"ro", "relatime"}, expected: true},
+		{name: "read-only requested", flags: unix.MS_RDONLY, options: []string{"rw", "relatime"}, expected: false},
+		{name: "read-write requested", options: []string{"ro", "relatime"}, expected: false},
+		{name: "requested flags", flags: unix.MS_NOATIME | unix.MS_NODEV, options: []string{"rw", "nodev", "noatime"}, expected: true},
+		{name: "missing flag", flags: unix.MS_NOEXEC, options: []string{"rw", "nodev"}, expected: false},
+		{name: "strictatime", flags: unix.MS_STRICTATIME, options: []string{"rw"}, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := mountOptions{flags: tt.flags}
+			if got := options.matches(MountInfo{Options: tt.options}); got != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestHasFilesystemOption(t *testing.T) {
+	superOptions := []string{"rw", "ssd", "discard=async", "space_cache=v2", "subvolid=5", "subvol=/"}
+
+	tests := []struct {
+		option   string
+		expected bool
+	}{
+		{option: "discard=async", expected: true},
+		{option: "discard", expected: false},
+		{option: "nodiscard", expected: false},
+		{option: "autodefrag", expected: false},
+		{option: "noautodefrag", expected: true},
+		{option: "noflushoncommit", expected: true},
+		{option: "commit=30", expected: true},
+		{option: "commit=120", expected: false},
+	}
+
+	for _, tt := range tests {
+		if got := hasFilesystemOption(superOptions, tt.option); got != tt.expected {
+			t.Errorf("hasFilesystemOption(%q) = %v, expected %v", tt.option, got, tt.expected)
+		}
+	}
+
+	if !hasFilesystemOption([]string{"rw", "discard", "commit=120"}, "discard=sync") {
+		t.Error("Expected discard=sync to match discard")
+	}
+	if hasFilesystemOption([]string{"rw", "commit=120"}, "commit=30") {
+		t.Error("Expected the default commit interval not to match commit=120")
+	}
+}
@@ -3,9 +3,9 @@ package driver
 import (
 	"context"
 	"os"
-	"path/filepath"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
@@ -21,6 +21,12 @@ func (d *BtrfsDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, err
 	}
 
+	unlock, err := d.lockVolumes(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	volumeID := req.GetVolumeId()
 	stagingTargetPath := req.GetStagingTargetPath()
 
@@ -43,6 +49,12 @@ func (d *BtrfsDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		return nil, err
 	}
 
+	unlock, err := d.lockVolumes(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	stagingTargetPath := req.GetStagingTargetPath()
 
 	// Remove staging directory
@@ -62,20 +74,67 @@ func (d *BtrfsDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, err
 	}
 
-	subvolumePath := req.GetVolumeId()
-	// Check if subvolume exists on the host
-	if _, err := os.Stat(filepath.Join("/host", subvolumePath)); os.IsNotExist(err) {
-		return nil, status.Errorf(codes.NotFound, "subvolume %s does not exist", subvolumePath)
+	unlock, err := d.lockVolumes(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	subvolumePath, err := d.resolveVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, resolveVolumeIDError(req.GetVolumeId(), err)
+	}
+	if err := d.validateDriverSubvolume(req.GetVolumeId(), subvolumePath, metadataTypeVolume); err != nil {
+		return nil, err
+	}
+
+	if req.GetVolumeCapability().GetBlock() != nil {
+		return d.nodePublishBlockVolume(req, subvolumePath)
+	}
+	if d.isBlockVolume(subvolumePath) {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is a raw block volume and cannot be mounted", req.GetVolumeId())
+	}
+
+	options, err := parseMountFlags(req.GetVolumeCapability().GetMount().GetMountFlags())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid mount flags: %v", err)
+	}
+	if isReadOnlyPublish(req) {
+		options.flags |= unix.MS_RDONLY
+	}
+	if err := checkFilesystemOptions(subvolumePath, options); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "unsupported mount flags: %v", err)
 	}
 
 	targetPath := req.GetTargetPath()
+	// Check if the volume is already published at the target path
+	mount, err := findMount(hostPath(targetPath))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check mount of target path %s: %v", targetPath, err)
+	}
+	if mount != nil {
+		sameSubvolume, err := isSameSubvolume(subvolumePath, targetPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check mount of target path %s: %v", targetPath, err)
+		}
+		if !sameSubvolume {
+			return nil, status.Errorf(codes.AlreadyExists, "target path %s is already used by another mount", targetPath)
+		}
+		if !options.matches(*mount) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s is already published at %s with different mount flags %v",
+				subvolumePath, targetPath, mount.Options)
+		}
+		klog.Infof("NodePublishVolume: volume %s is already mounted at %s", subvolumePath, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	// Create target directory
-	if err := os.MkdirAll(filepath.Join("/host", targetPath), 0755); err != nil {
+	if err := os.MkdirAll(hostPath(targetPath), 0755); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create target directory %s: %v", targetPath, err)
 	}
 
 	// Mount the existing subvolume to target path
-	if err := d.mountSubvolume(subvolumePath, targetPath); err != nil {
+	if err := d.mountSubvolume(subvolumePath, targetPath, options); err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to mount subvolume: %v", err)
 	}
 
@@ -84,6 +143,58 @@ func (d *BtrfsDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// nodePublishBlockVolume publishes a raw block volume by bind mounting a loop device of its image to the target path
+func (d *BtrfsDriver) nodePublishBlockVolume(req *csi.NodePublishVolumeRequest, subvolumePath string) (*csi.NodePublishVolumeResponse, error) {
+	if !d.isBlockVolume(subvolumePath) {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s is not a raw block volume", req.GetVolumeId())
+	}
+	readOnly := isReadOnlyPublish(req)
+
+	targetPath := req.GetTargetPath()
+	// Check if the volume is already published at the target path
+	mount, err := findMount(hostPath(targetPath))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check mount of target path %s: %v", targetPath, err)
+	}
+	if mount != nil {
+		published, err := d.isBlockVolumePublished(subvolumePath, targetPath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check mount of target path %s: %v", targetPath, err)
+		}
+		if !published {
+			return nil, status.Errorf(codes.AlreadyExists, "target path %s is already used by another mount", targetPath)
+		}
+		if mount.HasOption("ro") != readOnly {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s is already published at %s with different mount flags %v",
+				subvolumePath, targetPath, mount.Options)
+		}
+		klog.Infof("NodePublishVolume: block volume %s is already published at %s", subvolumePath, targetPath)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	if err := d.publishBlockVolume(subvolumePath, targetPath, readOnly); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to publish block volume: %v", err)
+	}
+
+	klog.Infof("NodePublishVolume: block volume %s published at %s", subvolumePath, targetPath)
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// isReadOnlyPublish returns whether the volume must be published read-only,
+// either because the publish request is read-only or because of its access mode
+func isReadOnlyPublish(req *csi.NodePublishVolumeRequest) bool {
+	if req.GetReadonly() {
+		return true
+	}
+	switch req.GetVolumeCapability().GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	default:
+		return false
+	}
+}
+
 func (d *BtrfsDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	klog.Infof("NodeUnpublishVolume: called with args %+v", req)
 
@@ -91,12 +202,31 @@ func (d *BtrfsDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, err
 	}
 
+	unlock, err := d.lockVolumes(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	volumeID := req.GetVolumeId()
 	targetPath := req.GetTargetPath()
 
 	// Unmount the volume
 	if err := d.unmountVolume(targetPath); err != nil {
-		klog.Warningf("Failed to unmount volume at %s: %v", targetPath, err)
+		return nil, status.Errorf(codes.Internal, "failed to unmount volume at %s: %v", targetPath, err)
+	}
+
+	// Remove the target directory (or file for raw block volumes) created in NodePublishVolume
+	if err := os.Remove(hostPath(targetPath)); err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "failed to remove target directory %s: %v", targetPath, err)
+	}
+
+	// Loop devices of raw block volumes are detached once they are not published anymore.
+	// The volume may already be gone, in which case there is nothing to detach.
+	if subvolumePath, err := d.resolveVolumeID(volumeID); err == nil && isBtrfsSubvolume(subvolumePath) && d.isBlockVolume(subvolumePath) {
+		if err := d.detachUnusedLoopDevices(subvolumePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to detach loop devices of volume %s: %v", volumeID, err)
+		}
 	}
 
 	klog.Infof("NodeUnpublishVolume: volume %s removed from %s", volumeID, targetPath)
@@ -117,29 +247,118 @@ func (d *BtrfsDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Error(codes.InvalidArgument, "volume path is required")
 	}
 
-	// Get volume statistics using btrfs commands
-	usage, err := d.getBtrfsFilesystemUsage(volumePath)
+	subvolumePath, err := d.resolveVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, resolveVolumeIDError(req.GetVolumeId(), err)
+	}
+	if !isBtrfsSubvolume(subvolumePath) {
+		return nil, status.Errorf(codes.NotFound, "subvolume %s does not exist", subvolumePath)
+	}
+	if _, err := os.Stat(hostPath(volumePath)); os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+	}
+
+	// The usage of a raw block volume is the space allocated for its image
+	if d.isBlockVolume(subvolumePath) {
+		size, allocated, err := getBlockImageUsage(subvolumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to get volume stats: %v", err)
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Unit:      csi.VolumeUsage_BYTES,
+					Available: max(size-allocated, 0),
+					Total:     size,
+					Used:      allocated,
+				},
+			},
+		}, nil
+	}
+
+	// Get volume statistics of the subvolume
+	usage, err := d.getVolumeUsage(subvolumePath, volumePath)
 	if err != nil {
 		klog.Errorf("Failed to get volume stats for %s: %v", volumePath, err)
 		return nil, status.Errorf(codes.Internal, "failed to get volume stats: %v", err)
 	}
 
+	// The usage is reported in bytes on disk, which already includes the savings of compression.
+	// CSI cannot report the compression ratio, therefore it is logged and exported as a metric.
+	if metadata, err := d.readVolumeMetadata(subvolumePath); err == nil && metadata.IsCompressed() {
+		if stats, err := d.getCompressionStats(subvolumePath); err == nil {
+			klog.V(4).Infof("NodeGetVolumeStats: volume %s stores %d bytes of data in %d bytes (compression ratio %.2f)",
+				subvolumePath, stats.UncompressedBytes, stats.DiskBytes, stats.Ratio())
+		} else {
+			klog.V(4).Infof("Unable to get compression stats of volume %s: %v", subvolumePath, err)
+		}
+	}
+
 	return &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			{
 				Unit:      csi.VolumeUsage_BYTES,
-				Available: usage.FreeEstimated,
-				Total:     usage.DeviceSize,
-				Used:      usage.Used,
+				Available: usage.AvailableBytes,
+				Total:     usage.TotalBytes,
+				Used:      usage.UsedBytes,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Available: usage.AvailableInodes,
+				Total:     usage.TotalInodes,
+				Used:      usage.UsedInodes,
 			},
 		},
 	}, nil
 }
 
 // Volume expansion is handled by the controller, not the node service
-// This allows for ONLINE and OFFLINE volume expansion
+// This allows for ONLINE and OFFLINE volume expansion.
+// The node only updates the capacity of the loop devices of raw block volumes after their image was resized.
 func (d *BtrfsDriver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	klog.Infof("NodeExpandVolume: called with args %+v", req)
+
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
+	}
+	if req.GetVolumePath() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume path is required")
+	}
+
+	unlock, err := d.lockVolumes(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	subvolumePath, err := d.resolveVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, resolveVolumeIDError(req.GetVolumeId(), err)
+	}
+	if !isBtrfsSubvolume(subvolumePath) {
+		return nil, status.Errorf(codes.NotFound, "subvolume %s does not exist", subvolumePath)
+	}
+	if !d.isBlockVolume(subvolumePath) {
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: req.GetCapacityRange().GetRequiredBytes()}, nil
+	}
+
+	devices, err := findLoopDevices(subvolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to expand volume: %v", err)
+	}
+	for _, device := range devices {
+		if err := refreshLoopDevice(device); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to expand volume: %v", err)
+		}
+	}
+	size, _, err := getBlockImageUsage(subvolumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get size of volume: %v", err)
+	}
+
+	klog.Infof("NodeExpandVolume: updated capacity of block volume %s to %d bytes", subvolumePath, size)
+
+	return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
 }
 
 func (d *BtrfsDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
@@ -160,6 +379,13 @@ func (d *BtrfsDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 				},
 			},
 		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
 	}
 
 	return &csi.NodeGetCapabilitiesResponse{
@@ -0,0 +1,163 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// StorageClass parameters
+const (
+	subvolumeRootParameter = "subvolumeRoot"
+	enableQuotasParameter  = "enableQuotas"
+	requireQuotasParameter = "requireQuotas"
+	quotaModeParameter     = "quotaMode"
+	preallocateParameter   = "preallocate"
+	noDataCOWParameter     = "nodatacow"
+	compressionParameter   = "compression"
+)
+
+// QuotaAccounting is a kind of Btrfs quota accounting
+type QuotaAccounting string
+
+const (
+	QuotaAccountingNone   QuotaAccounting = "none"
+	QuotaAccountingQgroup QuotaAccounting = "qgroup" // full qgroup accounting
+	QuotaAccountingSimple QuotaAccounting = "simple" // simple quotas (squota, Linux 6.7+)
+)
+
+// parseQuotaAccounting parses the quota accounting of the enableQuotas parameter or flag
+func parseQuotaAccounting(value string) (QuotaAccounting, error) {
+	switch accounting := QuotaAccounting(value); accounting {
+	case QuotaAccountingNone, QuotaAccountingQgroup, QuotaAccountingSimple:
+		return accounting, nil
+	default:
+		return "", fmt.Errorf("invalid quota accounting %q, must be one of %q, %q or %q",
+			value, QuotaAccountingNone, QuotaAccountingQgroup, QuotaAccountingSimple)
+	}
+}
+
+// QuotaMode selects which bytes of a volume are limited by its quota
+type QuotaMode string
+
+const (
+	// QuotaModeReferenced limits all data referenced by the volume, including data shared with snapshots and clones
+	QuotaModeReferenced QuotaMode = "referenced"
+	// QuotaModeExclusive limits the data that is not shared with any other subvolume
+	QuotaModeExclusive QuotaMode = "exclusive"
+	// QuotaModeNone does not limit the volume
+	QuotaModeNone QuotaMode = "none"
+)
+
+// parseQuotaMode parses the quotaMode parameter
+func parseQuotaMode(value string) (QuotaMode, error) {
+	switch mode := QuotaMode(value); mode {
+	case QuotaModeReferenced, QuotaModeExclusive, QuotaModeNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid quota mode %q, must be one of %q, %q or %q",
+			value, QuotaModeReferenced, QuotaModeExclusive, QuotaModeNone)
+	}
+}
+
+// volumeParameters are the StorageClass parameters that control how a volume is created
+type volumeParameters struct {
+	// EnableQuotas is the quota accounting that is enabled on the filesystem of the subvolume root
+	// if quotas are disabled (none: leave quotas disabled)
+	EnableQuotas QuotaAccounting
+	// RequireQuotas fails the creation of volumes whose capacity cannot be enforced with a quota
+	RequireQuotas bool
+	// QuotaMode selects which bytes of the volume are limited to its capacity
+	QuotaMode QuotaMode
+	// Preallocate allocates the entire image of a raw block volume when it is created, instead of a sparse image
+	Preallocate bool
+	// NoDataCOW disables copy-on-write for the data of the volume
+	NoDataCOW bool
+	// NoDataSum records that the data of the volume is not checksummed, which Btrfs implies for NoDataCOW
+	NoDataSum bool
+	// Compression is the compression of the data of the volume, e.g. "zstd" or "none" (empty: inherit the filesystem default)
+	Compression string
+	// Block is set for raw block volumes. It is determined by the volume capabilities, not by a parameter.
+	Block bool
+}
+
+// parseVolumeParameters parses the StorageClass parameters of a CreateVolume request,
+// using the driver options as defaults
+func (d *BtrfsDriver) parseVolumeParameters(parameters map[string]string) (volumeParameters, error) {
+	params := volumeParameters{
+		EnableQuotas:  d.enableQuotas,
+		RequireQuotas: d.requireQuotas,
+		QuotaMode:     QuotaModeReferenced,
+	}
+
+	if value, ok := parameters[enableQuotasParameter]; ok {
+		accounting, err := parseQuotaAccounting(value)
+		if err != nil {
+			return params, fmt.Errorf("invalid parameter %s: %v", enableQuotasParameter, err)
+		}
+		params.EnableQuotas = accounting
+	}
+
+	if value, ok := parameters[requireQuotasParameter]; ok {
+		required, err := strconv.ParseBool(value)
+		if err != nil {
+			return params, fmt.Errorf("invalid parameter %s: %v", requireQuotasParameter, err)
+		}
+		params.RequireQuotas = required
+	}
+
+	if value, ok := parameters[quotaModeParameter]; ok {
+		mode, err := parseQuotaMode(value)
+		if err != nil {
+			return params, fmt.Errorf("invalid parameter %s: %v", quotaModeParameter, err)
+		}
+		params.QuotaMode = mode
+	}
+
+	if value, ok := parameters[preallocateParameter]; ok {
+		preallocate, err := strconv.ParseBool(value)
+		if err != nil {
+			return params, fmt.Errorf("invalid parameter %s: %v", preallocateParameter, err)
+		}
+		params.Preallocate = preallocate
+	}
+
+	if value, ok := parameters[noDataCOWParameter]; ok {
+		noDataCOW, err := strconv.ParseBool(value)
+		if err != nil {
+			return params, fmt.Errorf("invalid parameter %s: %v", noDataCOWParameter, err)
+		}
+		params.NoDataCOW = noDataCOW
+		// Btrfs never checksums data that is written in place
+		params.NoDataSum = noDataCOW
+	}
+
+	if value, ok := parameters[compressionParameter]; ok {
+		if value != "none" {
+			if err := validateCompression(value); err != nil {
+				return params, fmt.Errorf("invalid parameter %s: %v", compressionParameter, err)
+			}
+			if params.NoDataCOW {
+				return params, fmt.Errorf("invalid parameter %s: data without copy-on-write (%s) is never compressed",
+					compressionParameter, noDataCOWParameter)
+			}
+		}
+		params.Compression = value
+	}
+
+	return params, nil
+}
+
+// validateCompression validates the value of the compression parameter.
+// Levels such as "zstd:3" are rejected, since the compression property ignores them
+// and always uses the default level of the algorithm.
+func validateCompression(value string) error {
+	switch value {
+	case "zstd", "lzo", "zlib":
+		return nil
+	}
+	if algorithm, _, hasLevel := strings.Cut(value, ":"); hasLevel {
+		return fmt.Errorf("compression levels are not supported, use %q", algorithm)
+	}
+	return fmt.Errorf("unsupported compression algorithm %q", value)
+}
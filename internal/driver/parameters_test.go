@@ -0,0 +1,82 @@
+package driver
+
+import "testing"
+
+func TestParseVolumeParameters(t *testing.T) {
+	d := &BtrfsDriver{enableQuotas: QuotaAccountingNone}
+
+	tests := []struct {
+		name        string
+		parameters  map[string]string
+		expected    volumeParameters
+		expectError bool
+	}{
+		{name: "defaults", parameters: nil, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, QuotaMode: QuotaModeReferenced}},
+		{name: "enable qgroups", parameters: map[string]string{"enableQuotas": "qgroup"}, expected: volumeParameters{EnableQuotas: QuotaAccountingQgroup, QuotaMode: QuotaModeReferenced}},
+		{name: "enable simple quotas", parameters: map[string]string{"enableQuotas": "simple"}, expected: volumeParameters{EnableQuotas: QuotaAccountingSimple, QuotaMode: QuotaModeReferenced}},
+		{name: "require quotas", parameters: map[string]string{"requireQuotas": "true"}, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, RequireQuotas: true, QuotaMode: QuotaModeReferenced}},
+		{name: "unrelated parameters", parameters: map[string]string{"subvolumeRoot": "/var/lib/btrfs-csi"}, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, QuotaMode: QuotaModeReferenced}},
+		{name: "exclusive quota", parameters: map[string]string{"quotaMode": "exclusive"}, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, QuotaMode: QuotaModeExclusive}},
+		{name: "no quota", parameters: map[string]string{"quotaMode": "none"}, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, QuotaMode: QuotaModeNone}},
+		{name: "preallocate", parameters: map[string]string{"preallocate": "true"}, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, QuotaMode: QuotaModeReferenced, Preallocate: true}},
+		{name: "nodatacow", parameters: map[string]string{"nodatacow": "true"}, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, QuotaMode: QuotaModeReferenced, NoDataCOW: true, NoDataSum: true}},
+		{name: "compression", parameters: map[string]string{"compression": "zstd"}, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, QuotaMode: QuotaModeReferenced, Compression: "zstd"}},
+		{name: "no compression", parameters: map[string]string{"compression": "none"}, expected: volumeParameters{EnableQuotas: QuotaAccountingNone, QuotaMode: QuotaModeReferenced, Compression: "none"}},
+		{name: "invalid quota accounting", parameters: map[string]string{"enableQuotas": "true"}, expectError: true},
+		{name: "invalid require quotas", parameters: map[string]string{"requireQuotas": "maybe"}, expectError: true},
+		{name: "invalid quota mode", parameters: map[string]string{"quotaMode": "shared"}, expectError: true},
+		{name: "invalid preallocate", parameters: map[string]string{"preallocate": "full"}, expectError: true},
+		{name: "invalid nodatacow", parameters: map[string]string{"nodatacow": "yes please"}, expectError: true},
+		{name: "invalid compression", parameters: map[string]string{"compression": "brotli"}, expectError: true},
+		{name: "invalid compression level", parameters: map[string]string{"compression": "zstd:99"}, expectError: true},
+		{name: "compression level", parameters: map[string]string{"compression": "zlib:9"}, expectError: true},
+		{name: "compression no", parameters: map[string]string{"compression": "no"}, expectError: true},
+		{name: "compression without copy-on-write", parameters: map[string]string{"compression": "lzo", "nodatacow": "true"}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := d.parseVolumeParameters(tt.parameters)
+			if tt.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got %+v", params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if params != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, params)
+			}
+		})
+	}
+
+	// The StorageClass parameters override the driver defaults
+	d = &BtrfsDriver{enableQuotas: QuotaAccountingSimple, requireQuotas: true}
+	params, err := d.parseVolumeParameters(map[string]string{"enableQuotas": "none", "requireQuotas": "false"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if params.EnableQuotas != QuotaAccountingNone || params.RequireQuotas {
+		t.Errorf("Expected parameters to override driver defaults, got %+v", params)
+	}
+}
+
+func TestParseQuotaAccounting(t *testing.T) {
+	for _, value := range []string{"none", "qgroup", "simple"} {
+		accounting, err := parseQuotaAccounting(value)
+		if err != nil {
+			t.Errorf("Unexpected error for %q: %v", value, err)
+		}
+		if string(accounting) != value {
+			t.Errorf("Expected %q, got %q", value, accounting)
+		}
+	}
+
+	for _, value := range []string{"", "true", "squota"} {
+		if _, err := parseQuotaAccounting(value); err == nil {
+			t.Errorf("Expected error for %q", value)
+		}
+	}
+}
@@ -16,6 +16,9 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestSanity(t *testing.T) {
@@ -41,7 +44,9 @@ func TestSanity(t *testing.T) {
 	}
 
 	// Initialize the driver
-	driver, err := NewBtrfsDriver(testNodeID, testEndpoint)
+	driver, err := NewBtrfsDriver(testNodeID, testEndpoint, DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root")},
+	})
 	if err != nil {
 		t.Fatalf("Failed to create driver: %v", err)
 	}
@@ -80,7 +85,7 @@ func TestSanity(t *testing.T) {
 
 // TestIdentityService tests the identity service methods
 func TestIdentityService(t *testing.T) {
-	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock")
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{})
 	if err != nil {
 		t.Fatalf("Failed to create driver: %v", err)
 	}
@@ -118,6 +123,38 @@ func TestIdentityService(t *testing.T) {
 	}
 }
 
+// TestNodeMode tests that a node-only driver does not advertise the controller service
+func TestNodeMode(t *testing.T) {
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{Mode: ModeNode})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %v", err)
+	}
+
+	ctx := context.Background()
+
+	pluginCapabilities, err := driver.GetPluginCapabilities(ctx, &csi.GetPluginCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("GetPluginCapabilities failed: %v", err)
+	}
+	for _, capability := range pluginCapabilities.Capabilities {
+		if capability.GetService().GetType() == csi.PluginCapability_Service_CONTROLLER_SERVICE {
+			t.Error("Expected node-only driver not to advertise the controller service")
+		}
+	}
+
+	controllerCapabilities, err := driver.ControllerGetCapabilities(ctx, &csi.ControllerGetCapabilitiesRequest{})
+	if err != nil {
+		t.Fatalf("ControllerGetCapabilities failed: %v", err)
+	}
+	if len(controllerCapabilities.Capabilities) != 0 {
+		t.Errorf("Expected no controller capabilities, got %v", controllerCapabilities.Capabilities)
+	}
+
+	if _, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{Mode: "invalid"}); err == nil {
+		t.Error("Expected invalid mode to be rejected")
+	}
+}
+
 // TestControllerService tests the controller service methods
 func TestControllerService(t *testing.T) {
 	tempDir, err := os.MkdirTemp("", "btrfs-csi-controller-*")
@@ -126,7 +163,9 @@ func TestControllerService(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock")
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root"), filepath.Join(tempDir, "btrfs-root-2")},
+	})
 	if err != nil {
 		t.Fatalf("Failed to create driver: %v", err)
 	}
@@ -176,10 +215,88 @@ func TestControllerService(t *testing.T) {
 	if createResp.Volume.VolumeId == "" {
 		t.Error("Expected non-empty volume ID")
 	}
+	if len(createResp.Volume.VolumeId) > maxVolumeIDLength {
+		t.Errorf("Expected volume ID of at most %d bytes, got %s", maxVolumeIDLength, createResp.Volume.VolumeId)
+	}
 	if createResp.Volume.CapacityBytes != capacity {
 		t.Errorf("Expected capacity %d, got %d", capacity, createResp.Volume.CapacityBytes)
 	}
 
+	// Test CreateVolume idempotency
+	repeatResp, err := driver.CreateVolume(ctx, createReq)
+	if err != nil {
+		t.Fatalf("Repeated CreateVolume failed: %v", err)
+	}
+	if repeatResp.Volume.VolumeId != createResp.Volume.VolumeId {
+		t.Errorf("Expected volume ID %s, got %s", createResp.Volume.VolumeId, repeatResp.Volume.VolumeId)
+	}
+
+	conflictReqs := map[string]*csi.CreateVolumeRequest{
+		"different capacity": {
+			Name:               volumeName,
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: 2 * capacity},
+			VolumeCapabilities: createReq.VolumeCapabilities,
+			Parameters:         createReq.Parameters,
+		},
+		"different parameters": {
+			Name:               volumeName,
+			CapacityRange:      createReq.CapacityRange,
+			VolumeCapabilities: createReq.VolumeCapabilities,
+			Parameters: map[string]string{
+				"subvolumeRoot": filepath.Join(tempDir, "btrfs-root"),
+				"foo":           "bar",
+			},
+		},
+		"different subvolume root": {
+			Name:               volumeName,
+			CapacityRange:      createReq.CapacityRange,
+			VolumeCapabilities: createReq.VolumeCapabilities,
+			Parameters: map[string]string{
+				"subvolumeRoot": filepath.Join(tempDir, "btrfs-root-2"),
+			},
+		},
+	}
+	for name, conflictReq := range conflictReqs {
+		if _, err := driver.CreateVolume(ctx, conflictReq); status.Code(err) != codes.AlreadyExists {
+			t.Errorf("Expected AlreadyExists for %s, got: %v", name, err)
+		}
+	}
+	if isBtrfsSubvolume(filepath.Join(tempDir, "btrfs-root-2", volumeName)) {
+		t.Errorf("Expected no second volume %s in another subvolume root", volumeName)
+	}
+
+	// Test ListVolumes
+	listResp, err := driver.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("ListVolumes failed: %v", err)
+	}
+	found := false
+	for _, entry := range listResp.Entries {
+		if entry.Volume.VolumeId == createResp.Volume.VolumeId {
+			found = true
+			if entry.Status.VolumeCondition.Abnormal {
+				t.Errorf("Expected volume to be healthy, got: %s", entry.Status.VolumeCondition.Message)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected volume %s in ListVolumes response", createResp.Volume.VolumeId)
+	}
+
+	// Test ControllerGetVolume
+	getResp, err := driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{
+		VolumeId: createResp.Volume.VolumeId,
+	})
+	if err != nil {
+		t.Fatalf("ControllerGetVolume failed: %v", err)
+	}
+	if getResp.Volume.CapacityBytes != capacity {
+		t.Errorf("Expected capacity %d, got %d", capacity, getResp.Volume.CapacityBytes)
+	}
+	if getResp.Status.VolumeCondition.Abnormal {
+		t.Errorf("Expected volume to be healthy, got: %s", getResp.Status.VolumeCondition.Message)
+	}
+
 	// Test ValidateVolumeCapabilities
 	validateReq := &csi.ValidateVolumeCapabilitiesRequest{
 		VolumeId: createResp.Volume.VolumeId,
@@ -212,6 +329,14 @@ func TestControllerService(t *testing.T) {
 	if err != nil {
 		t.Fatalf("DeleteVolume failed: %v", err)
 	}
+
+	// A deleted volume no longer exists
+	_, err = driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{
+		VolumeId: createResp.Volume.VolumeId,
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for deleted volume, got: %v", err)
+	}
 }
 
 // TestNodeService tests the node service methods
@@ -222,7 +347,9 @@ func TestNodeService(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock")
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root")},
+	})
 	if err != nil {
 		t.Fatalf("Failed to create driver: %v", err)
 	}
@@ -259,7 +386,9 @@ func TestVolumeExpansion(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock")
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root")},
+	})
 	if err != nil {
 		t.Fatalf("Failed to create driver: %v", err)
 	}
@@ -325,6 +454,222 @@ func TestVolumeExpansion(t *testing.T) {
 	}
 }
 
+// TestSnapshots tests snapshot creation, listing and deletion
+func TestSnapshots(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "btrfs-csi-snapshot-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %v", err)
+	}
+
+	ctx := context.Background()
+
+	// Create a source volume first
+	createReq := &csi.CreateVolumeRequest{
+		Name: "snapshot-source-volume",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: int64(1024 * 1024 * 1024), // 1GB
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			"subvolumeRoot": filepath.Join(tempDir, "btrfs-root"),
+		},
+	}
+
+	createResp, err := driver.CreateVolume(ctx, createReq)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	volumeID := createResp.Volume.VolumeId
+
+	// Test CreateSnapshot
+	snapshotReq := &csi.CreateSnapshotRequest{
+		Name:           "test-snapshot",
+		SourceVolumeId: volumeID,
+	}
+
+	snapshotResp, err := driver.CreateSnapshot(ctx, snapshotReq)
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if snapshotResp.Snapshot.SourceVolumeId != volumeID {
+		t.Errorf("Expected source volume ID %s, got %s", volumeID, snapshotResp.Snapshot.SourceVolumeId)
+	}
+	if !snapshotResp.Snapshot.ReadyToUse {
+		t.Error("Expected snapshot to be ready to use")
+	}
+
+	// Creating the same snapshot again must return the same snapshot
+	snapshotResp2, err := driver.CreateSnapshot(ctx, snapshotReq)
+	if err != nil {
+		t.Fatalf("Repeated CreateSnapshot failed: %v", err)
+	}
+	if snapshotResp2.Snapshot.SnapshotId != snapshotResp.Snapshot.SnapshotId {
+		t.Errorf("Expected snapshot ID %s, got %s", snapshotResp.Snapshot.SnapshotId, snapshotResp2.Snapshot.SnapshotId)
+	}
+
+	// A snapshot is not a volume
+	_, err = driver.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: snapshotResp.Snapshot.SnapshotId})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound for ControllerGetVolume of a snapshot, got: %v", err)
+	}
+
+	// Test ListSnapshots
+	listResp, err := driver.ListSnapshots(ctx, &csi.ListSnapshotsRequest{
+		SourceVolumeId: volumeID,
+	})
+	if err != nil {
+		t.Fatalf("ListSnapshots failed: %v", err)
+	}
+	if len(listResp.Entries) != 1 {
+		t.Fatalf("Expected 1 snapshot, got %d", len(listResp.Entries))
+	}
+	if listResp.Entries[0].Snapshot.SnapshotId != snapshotResp.Snapshot.SnapshotId {
+		t.Errorf("Expected snapshot ID %s, got %s", snapshotResp.Snapshot.SnapshotId, listResp.Entries[0].Snapshot.SnapshotId)
+	}
+
+	// Test CreateVolume from snapshot
+	restoreReq := &csi.CreateVolumeRequest{
+		Name:               "snapshot-restored-volume",
+		CapacityRange:      createReq.CapacityRange,
+		VolumeCapabilities: createReq.VolumeCapabilities,
+		Parameters:         createReq.Parameters,
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Snapshot{
+				Snapshot: &csi.VolumeContentSource_SnapshotSource{
+					SnapshotId: snapshotResp.Snapshot.SnapshotId,
+				},
+			},
+		},
+	}
+
+	restoreResp, err := driver.CreateVolume(ctx, restoreReq)
+	if err != nil {
+		t.Fatalf("CreateVolume from snapshot failed: %v", err)
+	}
+	if restoreResp.Volume.ContentSource.GetSnapshot().GetSnapshotId() != snapshotResp.Snapshot.SnapshotId {
+		t.Errorf("Expected content source snapshot %s, got %v", snapshotResp.Snapshot.SnapshotId, restoreResp.Volume.ContentSource)
+	}
+
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: restoreResp.Volume.VolumeId,
+	})
+	if err != nil {
+		t.Fatalf("DeleteVolume failed: %v", err)
+	}
+
+	// Test DeleteSnapshot
+	_, err = driver.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{
+		SnapshotId: snapshotResp.Snapshot.SnapshotId,
+	})
+	if err != nil {
+		t.Fatalf("DeleteSnapshot failed: %v", err)
+	}
+
+	// Clean up
+	_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: volumeID,
+	})
+	if err != nil {
+		t.Fatalf("DeleteVolume failed: %v", err)
+	}
+}
+
+// TestVolumeCloning tests creating a volume from an existing volume
+func TestVolumeCloning(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "btrfs-csi-clone-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %v", err)
+	}
+
+	ctx := context.Background()
+	capacity := int64(1024 * 1024 * 1024) // 1GB
+
+	createReq := &csi.CreateVolumeRequest{
+		Name: "clone-source-volume",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: capacity,
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			"subvolumeRoot": filepath.Join(tempDir, "btrfs-root"),
+		},
+	}
+
+	createResp, err := driver.CreateVolume(ctx, createReq)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+
+	// Test CreateVolume from volume
+	cloneReq := &csi.CreateVolumeRequest{
+		Name: "clone-volume",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: capacity,
+		},
+		VolumeCapabilities: createReq.VolumeCapabilities,
+		Parameters:         createReq.Parameters,
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{
+					VolumeId: createResp.Volume.VolumeId,
+				},
+			},
+		},
+	}
+
+	cloneResp, err := driver.CreateVolume(ctx, cloneReq)
+	if err != nil {
+		t.Fatalf("CreateVolume from volume failed: %v", err)
+	}
+	if cloneResp.Volume.ContentSource.GetVolume().GetVolumeId() != createResp.Volume.VolumeId {
+		t.Errorf("Expected content source volume %s, got %v", createResp.Volume.VolumeId, cloneResp.Volume.ContentSource)
+	}
+
+	// Clean up
+	for _, volumeID := range []string{cloneResp.Volume.VolumeId, createResp.Volume.VolumeId} {
+		_, err = driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+			VolumeId: volumeID,
+		})
+		if err != nil {
+			t.Fatalf("DeleteVolume failed: %v", err)
+		}
+	}
+}
+
 // Benchmark tests for performance testing
 func BenchmarkCreateVolume(b *testing.B) {
 	tempDir, err := os.MkdirTemp("", "btrfs-csi-bench-*")
@@ -333,7 +678,9 @@ func BenchmarkCreateVolume(b *testing.B) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock")
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root")},
+	})
 	if err != nil {
 		b.Fatalf("Failed to create driver: %v", err)
 	}
@@ -378,3 +725,153 @@ func BenchmarkCreateVolume(b *testing.B) {
 		}
 	}
 }
+
+func TestBlockVolume(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "btrfs-csi-block-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %v", err)
+	}
+
+	ctx := context.Background()
+
+	capacity := int64(64 * 1024 * 1024) // 64MB
+	createReq := &csi.CreateVolumeRequest{
+		Name: "block-test-volume",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: capacity,
+		},
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Block{
+					Block: &csi.VolumeCapability_BlockVolume{},
+				},
+				AccessMode: &csi.VolumeCapability_AccessMode{
+					Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+				},
+			},
+		},
+		Parameters: map[string]string{
+			"subvolumeRoot": filepath.Join(tempDir, "btrfs-root"),
+		},
+	}
+
+	createResp, err := driver.CreateVolume(ctx, createReq)
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	defer driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: createResp.Volume.VolumeId})
+
+	subvolumePath := filepath.Join(tempDir, "btrfs-root", "block-test-volume")
+	if !driver.isBlockVolume(subvolumePath) {
+		t.Fatal("Expected a raw block volume")
+	}
+	size, _, err := getBlockImageUsage(subvolumePath)
+	if err != nil {
+		t.Fatalf("Failed to get image size: %v", err)
+	}
+	if size != capacity {
+		t.Errorf("Expected image size %d, got %d", capacity, size)
+	}
+
+	// The access type must match the volume mode
+	validateResp, err := driver.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: createResp.Volume.VolumeId,
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("ValidateVolumeCapabilities failed: %v", err)
+	}
+	if validateResp.Confirmed != nil {
+		t.Error("Expected mount capability of a block volume not to be confirmed")
+	}
+
+	// Expanding the volume grows its image
+	newCapacity := 2 * capacity
+	expandResp, err := driver.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId: createResp.Volume.VolumeId,
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: newCapacity,
+		},
+	})
+	if err != nil {
+		t.Fatalf("ControllerExpandVolume failed: %v", err)
+	}
+	if expandResp.CapacityBytes != newCapacity {
+		t.Errorf("Expected expanded capacity %d, got %d", newCapacity, expandResp.CapacityBytes)
+	}
+	size, _, err = getBlockImageUsage(subvolumePath)
+	if err != nil {
+		t.Fatalf("Failed to get image size: %v", err)
+	}
+	if size != newCapacity {
+		t.Errorf("Expected image size %d, got %d", newCapacity, size)
+	}
+}
+
+func TestNoDataCOWVolume(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "btrfs-csi-nodatacow-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	driver, err := NewBtrfsDriver("test-node", "unix:///tmp/test.sock", DriverOptions{
+		SubvolumeRoots: []string{filepath.Join(tempDir, "btrfs-root")},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create driver: %v", err)
+	}
+
+	ctx := context.Background()
+
+	createResp, err := driver.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "nodatacow-test-volume",
+		CapacityRange: &csi.CapacityRange{
+			RequiredBytes: 64 * 1024 * 1024,
+		},
+		Parameters: map[string]string{
+			"subvolumeRoot": filepath.Join(tempDir, "btrfs-root"),
+			"nodatacow":     "true",
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume failed: %v", err)
+	}
+	defer driver.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: createResp.Volume.VolumeId})
+
+	subvolumePath := filepath.Join(tempDir, "btrfs-root", "nodatacow-test-volume")
+	f, err := os.Open(hostPath(subvolumePath))
+	if err != nil {
+		t.Fatalf("Failed to open subvolume: %v", err)
+	}
+	defer f.Close()
+	flags, err := unix.IoctlGetUint32(int(f.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		t.Fatalf("Failed to get attributes of subvolume: %v", err)
+	}
+	if flags&0x00800000 == 0 { // FS_NOCOW_FL
+		t.Error("Expected copy-on-write to be disabled for the subvolume")
+	}
+
+	metadata, err := driver.readVolumeMetadata(subvolumePath)
+	if err != nil || metadata == nil {
+		t.Fatalf("Failed to read volume metadata: %v", err)
+	}
+	if !metadata.NoDataCOW || !metadata.NoDataSum {
+		t.Errorf("Expected nodatacow and nodatasum in metadata, got %+v", metadata)
+	}
+}
@@ -0,0 +1,264 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/btrfs-csi/driver/internal/btrfs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeIDVersion is the prefix of the current volume ID format
+const volumeIDVersion = "v2"
+
+// volumeIDVersionV1 is the prefix of the previous volume ID format, which also contained the path of the subvolume
+const volumeIDVersionV1 = "v1"
+
+// maxVolumeIDLength is the maximum size of volume and snapshot IDs allowed by the CSI spec
+const maxVolumeIDLength = 128
+
+// errVolumeNotFound is returned when a volume or snapshot ID does not refer to a subvolume on the local node
+var errVolumeNotFound = errors.New("volume not found")
+
+// errVolumeOnOtherNode is returned when a volume or snapshot ID refers to a subvolume on another node
+var errVolumeOnOtherNode = errors.New("volume is located on another node")
+
+// errVolumeNotAllowed is returned when a volume or snapshot ID refers to a path outside of the configured subvolume roots
+var errVolumeNotAllowed = errors.New("volume is not located in a configured subvolume root")
+
+// VolumeID identifies the subvolume of a volume or snapshot.
+//
+// It is encoded as "v2:<node>:<filesystem UUID>:<subvolume ID>". The subvolume is looked up by its ID
+// in the subvolume roots on the filesystem, so the ID stays valid if the filesystem is mounted elsewhere
+// and it is unique across nodes. It does not contain the name or path of the subvolume, which would
+// not fit into the 128 bytes the CSI spec allows for IDs.
+// IDs of the previous format "v1:<node>:<filesystem UUID>:<subvolume ID>:<path>" are still accepted, and volumes
+// created by older versions of the driver are identified by the absolute host path of their subvolume.
+type VolumeID struct {
+	Node           string
+	FilesystemUUID string
+	SubvolumeID    uint64
+}
+
+// String returns the encoded volume ID
+func (id VolumeID) String() string {
+	return strings.Join([]string{volumeIDVersion, id.Node, id.FilesystemUUID, strconv.FormatUint(id.SubvolumeID, 10)}, ":")
+}
+
+// parseVolumeID decodes a volume ID in the current or the previous format
+func parseVolumeID(volumeID string) (VolumeID, error) {
+	parts := strings.SplitN(volumeID, ":", 5)
+	switch {
+	case len(parts) == 4 && parts[0] == volumeIDVersion:
+	case len(parts) == 5 && parts[0] == volumeIDVersionV1:
+		// The path is not needed to find the subvolume, but it must still be well-formed
+		if !filepath.IsLocal(parts[4]) || filepath.Clean(parts[4]) != parts[4] || parts[4] == "." {
+			return VolumeID{}, fmt.Errorf("invalid path in volume ID %q", volumeID)
+		}
+	default:
+		return VolumeID{}, fmt.Errorf("unsupported volume ID format: %q", volumeID)
+	}
+
+	subvolumeID, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil {
+		return VolumeID{}, fmt.Errorf("invalid subvolume ID in volume ID %q: %v", volumeID, err)
+	}
+
+	id := VolumeID{
+		Node:           parts[1],
+		FilesystemUUID: parts[2],
+		SubvolumeID:    subvolumeID,
+	}
+	if id.Node == "" || id.FilesystemUUID == "" {
+		return VolumeID{}, fmt.Errorf("missing node or filesystem in volume ID %q", volumeID)
+	}
+	return id, nil
+}
+
+// validateNodeID checks that volume IDs containing the given node ID do not exceed the size limit of the CSI spec
+func validateNodeID(nodeID string) error {
+	// Assume the longest possible filesystem UUID and subvolume ID
+	longest := VolumeID{Node: nodeID, FilesystemUUID: strings.Repeat("0", 36), SubvolumeID: math.MaxUint64}.String()
+	if len(longest) > maxVolumeIDLength {
+		return fmt.Errorf("node ID %q is too long, volume IDs containing it may exceed %d bytes", nodeID, maxVolumeIDLength)
+	}
+	return nil
+}
+
+// newVolumeID returns the ID of the volume or snapshot stored in the given subvolume
+func (d *BtrfsDriver) newVolumeID(subvolume SubvolumeInfo) (string, error) {
+	filesystemUUID, err := d.getFilesystemUUID(subvolume.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to get filesystem of %s: %v", subvolume.Path, err)
+	}
+
+	id := VolumeID{
+		Node:           d.nodeID,
+		FilesystemUUID: filesystemUUID,
+		SubvolumeID:    subvolume.ID,
+	}.String()
+	if len(id) > maxVolumeIDLength {
+		return "", fmt.Errorf("volume ID %s exceeds %d bytes", id, maxVolumeIDLength)
+	}
+	return id, nil
+}
+
+// lookupVolumeID returns the ID under which the volume or snapshot in the given subvolume is known to the CO
+func (d *BtrfsDriver) lookupVolumeID(subvolumePath string) string {
+	if metadata, err := d.readVolumeMetadata(subvolumePath); err == nil && metadata != nil && metadata.ID != "" {
+		return metadata.ID
+	}
+	// Volumes created by older versions of the driver are identified by their path
+	return subvolumePath
+}
+
+// resolveVolumeID returns the host path of the subvolume identified by the given volume or snapshot ID.
+// If the subvolume has been deleted, but its metadata is still left, the path it was located at is returned.
+func (d *BtrfsDriver) resolveVolumeID(volumeID string) (string, error) {
+	// Volume IDs of older versions of the driver are absolute host paths
+	if filepath.IsAbs(volumeID) {
+		if err := d.validateSubvolumePath(volumeID); err != nil {
+			return "", err
+		}
+		return volumeID, nil
+	}
+
+	id, err := parseVolumeID(volumeID)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errVolumeNotFound, err)
+	}
+	if id.Node != d.nodeID {
+		return "", fmt.Errorf("%w: volume %s is located on node %s", errVolumeOnOtherNode, volumeID, id.Node)
+	}
+
+	// Look for the subvolume in every subvolume root on the filesystem from the volume ID
+	for _, root := range d.getSubvolumeRoots() {
+		filesystemUUID, err := d.getFilesystemUUID(root)
+		if err != nil || filesystemUUID != id.FilesystemUUID {
+			continue
+		}
+
+		name, err := btrfs.GetSubvolumeName(hostPath(root), id.SubvolumeID)
+		if errors.Is(err, btrfs.ErrSubvolumeNotFound) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		// The filesystem may contain the subvolume anywhere, only consider the configured subvolume roots
+		subvolumePath := filepath.Join(root, name)
+		if err := d.validateSubvolumePath(subvolumePath); err != nil || !isBtrfsSubvolume(subvolumePath) {
+			continue
+		}
+		info, err := d.getSubvolumeInfo(subvolumePath)
+		if err != nil {
+			return "", err
+		}
+		if info.ID == id.SubvolumeID {
+			return subvolumePath, nil
+		}
+	}
+
+	// A different subvolume at the path of the deleted one must never be mistaken for it
+	if deletedPath := d.findMetadataByID(volumeID); deletedPath != "" {
+		if _, err := os.Lstat(hostPath(deletedPath)); errors.Is(err, os.ErrNotExist) {
+			return deletedPath, nil
+		}
+	}
+	return "", fmt.Errorf("%w: subvolume %d of filesystem %s does not exist", errVolumeNotFound, id.SubvolumeID, id.FilesystemUUID)
+}
+
+// resolveVolumeIDError converts an error from resolveVolumeID into a gRPC status error
+func resolveVolumeIDError(volumeID string, err error) error {
+	switch {
+	case errors.Is(err, errVolumeNotFound) || errors.Is(err, errVolumeOnOtherNode):
+		return status.Errorf(codes.NotFound, "volume %s does not exist: %v", volumeID, err)
+	case errors.Is(err, errVolumeNotAllowed):
+		return status.Errorf(codes.InvalidArgument, "invalid volume ID %s: %v", volumeID, err)
+	default:
+		return status.Errorf(codes.Internal, "failed to resolve volume ID %s: %v", volumeID, err)
+	}
+}
+
+// validateSubvolumeName checks that a volume or snapshot name can be used as the name of a subvolume in a subvolume root
+func validateSubvolumeName(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("name %q is not a valid subvolume name", name)
+	case strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("name %q must not contain slashes or NUL characters", name)
+	case name == metadataDirName:
+		return fmt.Errorf("name %q is reserved", name)
+	}
+	return nil
+}
+
+// validateSubvolumePath checks that the given host path is located directly in one of the configured
+// subvolume roots and cannot escape it through "..", symlinks or otherwise
+func (d *BtrfsDriver) validateSubvolumePath(subvolumePath string) error {
+	if !filepath.IsAbs(subvolumePath) || filepath.Clean(subvolumePath) != subvolumePath {
+		return fmt.Errorf("%w: %q is not a clean absolute path", errVolumeNotAllowed, subvolumePath)
+	}
+	if err := validateSubvolumeName(filepath.Base(subvolumePath)); err != nil {
+		return fmt.Errorf("%w: %v", errVolumeNotAllowed, err)
+	}
+
+	root := filepath.Dir(subvolumePath)
+	if !d.isSubvolumeRoot(root) {
+		return fmt.Errorf("%w: %s", errVolumeNotAllowed, subvolumePath)
+	}
+
+	// A symlink anywhere in the path could redirect the operation to an arbitrary location on the host
+	if resolved, err := filepath.EvalSymlinks(hostPath(root)); err == nil && resolved != hostPath(root) {
+		return fmt.Errorf("%w: subvolume root %s must not contain symlinks", errVolumeNotAllowed, root)
+	}
+	if info, err := os.Lstat(hostPath(subvolumePath)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %s is a symlink", errVolumeNotAllowed, subvolumePath)
+	}
+	return nil
+}
+
+// validateDriverSubvolume checks that the subvolume of a volume or snapshot exists and was created by the driver,
+// before it is deleted, mounted or modified
+func (d *BtrfsDriver) validateDriverSubvolume(volumeID, subvolumePath, metadataType string) error {
+	if !isBtrfsSubvolume(subvolumePath) {
+		return status.Errorf(codes.NotFound, "%s %s does not exist", metadataType, volumeID)
+	}
+
+	info, err := d.getSubvolumeInfo(subvolumePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get subvolume info of %s: %v", subvolumePath, err)
+	}
+	// Snapshots are the only read-only subvolumes created by the driver
+	if info.ReadOnly != (metadataType == metadataTypeSnapshot) {
+		return status.Errorf(codes.InvalidArgument, "subvolume %s is not a %s", subvolumePath, metadataType)
+	}
+
+	metadata, err := d.readVolumeMetadata(subvolumePath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read metadata of %s: %v", subvolumePath, err)
+	}
+	// Volumes created before the metadata store was introduced are known by their path.
+	// They are adopted on first use, in case their subvolume root was not mounted when the driver started.
+	if metadata == nil && d.adoptLegacy && volumeID == subvolumePath {
+		if metadata, err = d.adoptLegacySubvolume(info); err != nil {
+			return status.Errorf(codes.Internal, "failed to adopt legacy %s %s: %v", metadataType, subvolumePath, err)
+		}
+	}
+	if metadata == nil {
+		return status.Errorf(codes.FailedPrecondition, "subvolume %s was not created by this driver", subvolumePath)
+	}
+	if metadata.Type != metadataType {
+		return status.Errorf(codes.InvalidArgument, "subvolume %s is not a %s", subvolumePath, metadataType)
+	}
+	if metadata.ID != "" && metadata.ID != volumeID && metadata.LegacyID != volumeID {
+		return status.Errorf(codes.NotFound, "%s %s does not exist, subvolume %s belongs to %s", metadataType, volumeID, subvolumePath, metadata.ID)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVolumeID(t *testing.T) {
+	id := VolumeID{
+		Node:           "node-1",
+		FilesystemUUID: "4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90",
+		SubvolumeID:    256,
+	}
+
+	encoded := id.String()
+	if encoded != "v2:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:256" {
+		t.Errorf("Unexpected encoded volume ID: %s", encoded)
+	}
+
+	decoded, err := parseVolumeID(encoded)
+	if err != nil {
+		t.Fatalf("parseVolumeID failed: %v", err)
+	}
+	if decoded != id {
+		t.Errorf("Expected %+v, got %+v", id, decoded)
+	}
+
+	// IDs of the previous format are still accepted
+	decoded, err = parseVolumeID("v1:node-1:4f0c8e6a-3c1f-4b7e-9d3a-2b5e8c1d7f90:256:var/lib/btrfs-csi/pvc-1")
+	if err != nil {
+		t.Fatalf("parseVolumeID failed for v1 ID: %v", err)
+	}
+	if decoded != id {
+		t.Errorf("Expected %+v, got %+v", id, decoded)
+	}
+}
+
+func TestValidateNodeID(t *testing.T) {
+	if err := validateNodeID("ip-10-0-12-34.eu-central-1.compute.internal"); err != nil {
+		t.Errorf("Unexpected error for a typical node name: %v", err)
+	}
+	if err := validateNodeID(strings.Repeat("a", 63)); err != nil {
+		t.Errorf("Unexpected error for a node name of 63 bytes: %v", err)
+	}
+	if err := validateNodeID(strings.Repeat("a", 253)); err == nil {
+		t.Error("Expected an error for a node name of 253 bytes")
+	}
+}
+
+func TestParseVolumeIDInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"/var/lib/btrfs-csi/pvc-1",
+		"some-volume-id",
+		"v2:node-1:uuid:256:pvc-1",
+		"v1:node-1:uuid:256",
+		"v1::uuid:256:pvc-1",
+		"v1:node-1::256:pvc-1",
+		"v1:node-1:uuid:abc:pvc-1",
+		"v1:node-1:uuid:256:",
+		"v1:node-1:uuid:256:.",
+		"v1:node-1:uuid:256:/pvc-1",
+		"v1:node-1:uuid:256:../pvc-1",
+		"v1:node-1:uuid:256:root/../../pvc-1",
+		"v1:node-1:uuid:256:root//pvc-1",
+		"v2:node-1:uuid",
+		"v2::uuid:256",
+		"v2:node-1:uuid:abc",
+		"v3:node-1:uuid:256",
+	}
+
+	for _, tt := range tests {
+		if id, err := parseVolumeID(tt); err == nil {
+			t.Errorf("Expected error for %q, got %+v", tt, id)
+		}
+	}
+}
+
+func TestValidateSubvolumePath(t *testing.T) {
+	d := &BtrfsDriver{subvolumeRoots: []string{"/var/lib/btrfs-csi", "/mnt/data"}}
+
+	tests := []struct {
+		path        string
+		expectError bool
+	}{
+		{path: "/var/lib/btrfs-csi/pvc-1"},
+		{path: "/mnt/data/pvc-1"},
+		{path: "/", expectError: true},
+		{path: "/etc", expectError: true},
+		{path: "/var/lib/btrfs-csi", expectError: true},
+		{path: "/var/lib/btrfs-csi/../../../etc", expectError: true},
+		{path: "/var/lib/btrfs-csi/pvc-1/..", expectError: true},
+		{path: "/var/lib/btrfs-csi/pvc-1/nested", expectError: true},
+		{path: "/var/lib/btrfs-csi//pvc-1", expectError: true},
+		{path: "/var/lib/btrfs-csi/" + metadataDirName, expectError: true},
+		{path: "var/lib/btrfs-csi/pvc-1", expectError: true},
+		{path: "/var/lib/other/pvc-1", expectError: true},
+	}
+
+	for _, tt := range tests {
+		err := d.validateSubvolumePath(tt.path)
+		if tt.expectError && err == nil {
+			t.Errorf("Expected error for %q", tt.path)
+		} else if !tt.expectError && err != nil {
+			t.Errorf("Unexpected error for %q: %v", tt.path, err)
+		}
+	}
+}
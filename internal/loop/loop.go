@@ -0,0 +1,226 @@
+// Package loop manages loop devices through the ioctls of the kernel's loop driver (include/uapi/linux/loop.h),
+// so that attaching raw block volumes does not depend on losetup being installed on the nodes.
+package loop
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// controlName is the name of the loop control device, which hands out free loop devices
+	controlName = "loop-control"
+
+	// attachRetries is the number of free devices that are tried when another process
+	// grabs a device between LOOP_CTL_GET_FREE and attaching the file to it
+	attachRetries = 5
+)
+
+// Device is a loop device a file is attached to
+type Device struct {
+	Path     string // path of the device node, e.g. /dev/loop0
+	ReadOnly bool
+
+	// device and inode number of the backing file
+	BackingDevice uint64
+	BackingInode  uint64
+}
+
+// List returns the loop devices in the given device directory (usually /dev) that have a file attached
+func List(devDir string) ([]Device, error) {
+	entries, err := os.ReadDir(devDir)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := []Device{}
+	for _, entry := range entries {
+		if _, ok := deviceNumber(entry.Name()); !ok {
+			continue
+		}
+		device, err := GetStatus(filepath.Join(devDir, entry.Name()))
+		if errors.Is(err, unix.ENXIO) || errors.Is(err, os.ErrNotExist) {
+			// unbound device or removed in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// Find returns the loop devices in the given device directory the given file is attached to
+func Find(devDir, file string) ([]Device, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(file, &stat); err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", file, err)
+	}
+
+	devices, err := List(devDir)
+	if err != nil {
+		return nil, err
+	}
+	attached := []Device{}
+	for _, device := range devices {
+		if device.BackingDevice == stat.Dev && device.BackingInode == stat.Ino {
+			attached = append(attached, device)
+		}
+	}
+	return attached, nil
+}
+
+// GetStatus returns the status of the given loop device (LOOP_GET_STATUS64).
+// The error wraps ENXIO if no file is attached to the device.
+func GetStatus(devicePath string) (Device, error) {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return Device{}, err
+	}
+	defer f.Close()
+
+	info, err := unix.IoctlLoopGetStatus64(int(f.Fd()))
+	if err != nil {
+		return Device{}, fmt.Errorf("failed to get status of loop device %s: %w", devicePath, err)
+	}
+	return Device{
+		Path:          devicePath,
+		ReadOnly:      info.Flags&unix.LO_FLAGS_READ_ONLY != 0,
+		BackingDevice: info.Device,
+		BackingInode:  info.Inode,
+	}, nil
+}
+
+// Attach attaches the given file to a free loop device in the given device directory with direct I/O enabled
+func Attach(devDir, file string, readOnly bool) (Device, error) {
+	control, err := os.OpenFile(filepath.Join(devDir, controlName), os.O_RDWR, 0)
+	if err != nil {
+		return Device{}, err
+	}
+	defer control.Close()
+
+	for i := 0; ; i++ {
+		number, err := unix.IoctlRetInt(int(control.Fd()), unix.LOOP_CTL_GET_FREE)
+		if err != nil {
+			return Device{}, fmt.Errorf("failed to get free loop device: %w", err)
+		}
+
+		devicePath := filepath.Join(devDir, "loop"+strconv.Itoa(number))
+		err = attach(devicePath, file, readOnly)
+		if errors.Is(err, unix.EBUSY) && i < attachRetries {
+			continue
+		}
+		if err != nil {
+			return Device{}, err
+		}
+		return GetStatus(devicePath)
+	}
+}
+
+// attach attaches the file to the given loop device with LOOP_CONFIGURE,
+// or LOOP_SET_FD and LOOP_SET_STATUS64 on kernels before 5.8
+func attach(devicePath, file string, readOnly bool) error {
+	mode := os.O_RDWR
+	flags := uint32(unix.LO_FLAGS_DIRECT_IO)
+	if readOnly {
+		mode = os.O_RDONLY
+		flags |= unix.LO_FLAGS_READ_ONLY
+	}
+
+	backing, err := os.OpenFile(file, mode, 0)
+	if err != nil {
+		return err
+	}
+	defer backing.Close()
+
+	device, err := os.OpenFile(devicePath, mode, 0)
+	if err != nil {
+		return err
+	}
+	defer device.Close()
+
+	config := unix.LoopConfig{
+		Fd:   uint32(backing.Fd()),
+		Info: unix.LoopInfo64{Flags: flags, File_name: fileName(file)},
+	}
+	err = unix.IoctlLoopConfigure(int(device.Fd()), &config)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, unix.EINVAL) && !errors.Is(err, unix.ENOTTY) {
+		return fmt.Errorf("failed to attach %s to loop device %s: %w", file, devicePath, err)
+	}
+
+	// The file descriptor determines whether the device is read-only
+	if err := unix.IoctlSetInt(int(device.Fd()), unix.LOOP_SET_FD, int(backing.Fd())); err != nil {
+		return fmt.Errorf("failed to attach %s to loop device %s: %w", file, devicePath, err)
+	}
+	info := unix.LoopInfo64{File_name: fileName(file)}
+	if err := unix.IoctlLoopSetStatus64(int(device.Fd()), &info); err != nil {
+		_ = unix.IoctlSetInt(int(device.Fd()), unix.LOOP_CLR_FD, 0)
+		return fmt.Errorf("failed to set status of loop device %s: %w", devicePath, err)
+	}
+	// Direct I/O is an optimization, the device works without it
+	_ = unix.IoctlSetInt(int(device.Fd()), unix.LOOP_SET_DIRECT_IO, 1)
+	return nil
+}
+
+// Detach detaches the file from the given loop device (LOOP_CLR_FD).
+// The kernel detaches the file once the device is closed by all users.
+func Detach(devicePath string) error {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := unix.IoctlSetInt(int(f.Fd()), unix.LOOP_CLR_FD, 0); err != nil {
+		return fmt.Errorf("failed to detach loop device %s: %w", devicePath, err)
+	}
+	return nil
+}
+
+// SetCapacity updates the size of the given loop device after its file was resized (LOOP_SET_CAPACITY)
+func SetCapacity(devicePath string) error {
+	f, err := os.Open(devicePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := unix.IoctlSetInt(int(f.Fd()), unix.LOOP_SET_CAPACITY, 0); err != nil {
+		return fmt.Errorf("failed to update capacity of loop device %s: %w", devicePath, err)
+	}
+	return nil
+}
+
+// deviceNumber returns the number of a loop device node name, e.g. 12 for "loop12".
+// Partitions ("loop0p1") and the control device are not loop devices.
+func deviceNumber(name string) (int, bool) {
+	digits, ok := strings.CutPrefix(name, "loop")
+	if !ok || digits == "" {
+		return 0, false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	number, err := strconv.Atoi(digits)
+	return number, err == nil
+}
+
+// fileName returns the file name stored in the status of a loop device, which is informational
+// and truncated to the size of the field (lo_file_name) including its terminating null byte
+func fileName(file string) [unix.LO_NAME_SIZE]uint8 {
+	var name [unix.LO_NAME_SIZE]uint8
+	copy(name[:unix.LO_NAME_SIZE-1], file)
+	return name
+}
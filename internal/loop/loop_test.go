@@ -0,0 +1,58 @@
+package loop
+
+import (
+	"strings"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestIoctlArgSizes verifies that the ioctl argument structs match the kernel's layout
+func TestIoctlArgSizes(t *testing.T) {
+	if size := unsafe.Sizeof(unix.LoopInfo64{}); size != 232 {
+		t.Errorf("Expected size of loop_info64 to be 232, got %d", size)
+	}
+	if size := unsafe.Sizeof(unix.LoopConfig{}); size != 304 {
+		t.Errorf("Expected size of loop_config to be 304, got %d", size)
+	}
+}
+
+func TestDeviceNumber(t *testing.T) {
+	tests := []struct {
+		name     string
+		number   int
+		expected bool
+	}{
+		{name: "loop0", number: 0, expected: true},
+		{name: "loop12", number: 12, expected: true},
+		{name: "loop-control"},
+		{name: "loop0p1"},
+		{name: "loop"},
+		{name: "loop+1"},
+		{name: "sda1"},
+	}
+
+	for _, tt := range tests {
+		number, ok := deviceNumber(tt.name)
+		if ok != tt.expected || number != tt.number {
+			t.Errorf("deviceNumber(%q) = %d, %t, expected %d, %t", tt.name, number, ok, tt.number, tt.expected)
+		}
+	}
+}
+
+func TestFileName(t *testing.T) {
+	name := fileName("/var/lib/btrfs-csi/pvc-1/disk.img")
+	if s := strings.TrimRight(string(name[:]), "\x00"); s != "/var/lib/btrfs-csi/pvc-1/disk.img" {
+		t.Errorf("Unexpected file name %q", s)
+	}
+
+	long := "/" + strings.Repeat("a", 100)
+	name = fileName(long)
+	if name[unix.LO_NAME_SIZE-1] != 0 {
+		t.Error("Expected file name to be null terminated")
+	}
+	if s := string(name[:unix.LO_NAME_SIZE-1]); s != long[:unix.LO_NAME_SIZE-1] {
+		t.Errorf("Unexpected truncated file name %q", s)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
 	"github.com/btrfs-csi/driver/internal/driver"
 	"k8s.io/klog/v2"
@@ -11,6 +12,14 @@ import (
 var (
 	endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI endpoint")
 	nodeID   = flag.String("nodeid", "", "node id")
+
+	mode               = flag.String("mode", string(driver.ModeAll), "CSI services to serve: controller, node or all")
+	metricsAddress     = flag.String("metrics-address", "", "address on which to serve Prometheus metrics, e.g. :9808 (disabled if empty)")
+	healthAddress      = flag.String("health-address", "", "address on which to serve the /healthz and /livez endpoints, e.g. :9809 (disabled if empty)")
+	enableQuotas       = flag.String("enable-quotas", string(driver.QuotaAccountingNone), "quota accounting to enable on subvolume roots without quotas: none, qgroup or simple")
+	requireQuotas      = flag.Bool("require-quotas", false, "fail CreateVolume instead of creating volumes without quota limit")
+	adoptLegacyVolumes = flag.Bool("adopt-legacy-volumes", true, "record subvolumes without metadata in the subvolume roots as volumes and snapshots created by older versions of the driver")
+	subvolumeRoots     = flag.String("subvolume-roots", driver.DefaultBtrfsPath, "comma-separated list of host directories in which volumes may be created")
 )
 
 func main() {
@@ -26,12 +35,20 @@ func main() {
 		klog.Fatalf("nodeid is required")
 	}
 
-	drv, err := driver.NewBtrfsDriver(*nodeID, *endpoint)
+	drv, err := driver.NewBtrfsDriver(*nodeID, *endpoint, driver.DriverOptions{
+		SubvolumeRoots:     strings.Split(*subvolumeRoots, ","),
+		Mode:               driver.Mode(*mode),
+		MetricsAddress:     *metricsAddress,
+		HealthAddress:      *healthAddress,
+		EnableQuotas:       driver.QuotaAccounting(*enableQuotas),
+		RequireQuotas:      *requireQuotas,
+		AdoptLegacyVolumes: *adoptLegacyVolumes,
+	})
 	if err != nil {
 		klog.Fatalf("Failed to initialize driver: %v", err)
 	}
 
-	klog.Infof("Starting Btrfs CSI driver on node %s", *nodeID)
+	klog.Infof("Starting Btrfs CSI driver on node %s in %s mode", *nodeID, *mode)
 	if err := drv.Run(); err != nil {
 		klog.Fatalf("Failed to run driver: %v", err)
 	}